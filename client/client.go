@@ -2,7 +2,7 @@ package client
 
 import (
 	"context"
-	"time"
+	"os"
 
 	"github.com/biandc/nhole/pkg/config"
 	"github.com/biandc/nhole/pkg/control"
@@ -17,7 +17,7 @@ var (
 	LogDisableColor bool
 )
 
-func Run(cfg *config.ClientCfg) (err error) {
+func Run(cfgFile string, cfg *config.ClientCfg) (err error) {
 	tools.PrintLogo()
 	log.InitLog(LogWay, LogFile, LogLevel, LogDisableColor)
 
@@ -25,22 +25,17 @@ func Run(cfg *config.ClientCfg) (err error) {
 		clienter *control.ControlClient
 	)
 	ctx := context.WithValue(context.Background(), "cfg", cfg)
+	ctx = context.WithValue(ctx, "cfgFile", cfgFile)
 	clienter, err = control.NewControlClienter(ctx, cfg.Server.Ip, cfg.Server.ControlPort)
 	if err != nil {
 		return
 	}
-	go func() {
-		for {
-			err := clienter.Init()
-			if err != nil {
-				log.Error(err.Error())
-				time.Sleep(1 * time.Second)
-				continue
-			}
-			clienter.Run()
-		}
-	}()
+	go clienter.Serve()
 	log.Info("nhole-client start ...")
-	tools.ExitClear(clienter, "nhole-client exit ...")
+	err = tools.ExitClear(clienter, "nhole-client exit ...")
+	if err != nil {
+		log.Error(err.Error())
+		os.Exit(tools.ExitDrainTimeout)
+	}
 	return
 }
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/biandc/nhole/pkg/control"
+)
+
+// PrintStatus prints the status served by a running nhole-client on addr.
+func PrintStatus(addr string, asJSON bool) (err error) {
+	err = printStatus(os.Stdout, addr, asJSON)
+	return
+}
+
+func printStatus(out io.Writer, addr string, asJSON bool) (err error) {
+	var (
+		resp   *http.Response
+		body   []byte
+		status control.LocalStatus
+	)
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	resp, err = httpClient.Get(fmt.Sprintf("http://%s/api/status", addr))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("status api %s %s", resp.Status, strings.TrimSpace(string(body)))
+		return
+	}
+	if asJSON {
+		_, err = out.Write(body)
+		return
+	}
+	err = json.Unmarshal(body, &status)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(out, "server:    %s\n", status.Server)
+	fmt.Fprintf(out, "state:     %s\n", status.State)
+	fmt.Fprintf(out, "client id: %s\n", status.ClientID)
+	if status.ErrorInfo != "" {
+		fmt.Fprintf(out, "error:     %s\n", status.ErrorInfo)
+	}
+	fmt.Fprintln(out)
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPROTOCOL\tLOCAL\tREMOTE\tSTATE\tCONNECTIONS\tERROR")
+	for _, service := range status.Services {
+		remote := fmt.Sprint(service.ForwardPort)
+		if len(service.CustomDomains) > 0 {
+			remote = strings.Join(service.CustomDomains, ",")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			service.Name,
+			service.Protocol,
+			service.LocalAddr,
+			remote,
+			service.State,
+			service.Connections,
+			service.ErrorInfo,
+		)
+	}
+	err = w.Flush()
+	return
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/biandc/nhole/pkg/control"
+)
+
+func TestPrintStatus(t *testing.T) {
+	status := &control.LocalStatus{
+		State:    control.StateRegistered,
+		ClientID: "c1",
+		Server:   "127.0.0.1:7000",
+		Services: []*control.ServiceStatus{
+			{Name: "ssh", Protocol: "tcp", LocalAddr: "127.0.0.1:22", ForwardPort: 6022, State: control.ServiceActive, Connections: 2},
+			{Name: "web", Protocol: "http", LocalAddr: "127.0.0.1:80", CustomDomains: []string{"a.example.com", "b.example.com"},
+				State: control.ServiceFailed, ErrorInfo: "domain in use"},
+		},
+	}
+	body, _ := json.Marshal(status)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/status" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(body)
+	}))
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	out := new(bytes.Buffer)
+	if err := printStatus(out, addr, true); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), body) {
+		t.Fatalf("--json printed %s", out)
+	}
+
+	out.Reset()
+	if err := printStatus(out, addr, false); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(out.String(), "\n")
+	for _, want := range [][]string{
+		{"server:", "127.0.0.1:7000"},
+		{"state:", "registered"},
+		{"client", "id:", "c1"},
+		{},
+		{"NAME", "PROTOCOL", "LOCAL", "REMOTE", "STATE", "CONNECTIONS", "ERROR"},
+		{"ssh", "tcp", "127.0.0.1:22", "6022", "active", "2"},
+		{"web", "http", "127.0.0.1:80", "a.example.com,b.example.com", "failed", "0", "domain", "in", "use"},
+	} {
+		if got := strings.Fields(lines[0]); strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Fatalf("printed %q, want %q", lines[0], strings.Join(want, " "))
+		}
+		lines = lines[1:]
+	}
+
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+	defer busy.Close()
+	if err := printStatus(out, strings.TrimPrefix(busy.URL, "http://"), false); err == nil || !strings.Contains(err.Error(), "busy") {
+		t.Fatalf("error status printed %v", err)
+	}
+}
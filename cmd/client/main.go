@@ -15,8 +15,10 @@ const (
 )
 
 var (
-	version bool
-	cfgFile string
+	version    bool
+	cfgFile    string
+	statusAddr string
+	statusJSON bool
 )
 
 func init() {
@@ -26,6 +28,9 @@ func init() {
 	rootCmd.PersistentFlags().StringVarP(&client.LogFile, "log_file", "", "", "log save file.")
 	rootCmd.PersistentFlags().StringVarP(&client.LogLevel, "log_level", "", "info", "log level.(error|warn|info|debug|trace)")
 	rootCmd.PersistentFlags().BoolVarP(&client.LogDisableColor, "log_disable_color", "", false, "disable log color.")
+	statusCmd.Flags().StringVarP(&statusAddr, "addr", "", "", "status api address, default status_addr of the config file.")
+	statusCmd.Flags().BoolVarP(&statusJSON, "json", "", false, "print the status as json.")
+	rootCmd.AddCommand(statusCmd)
 }
 
 var rootCmd = &cobra.Command{
@@ -39,11 +44,30 @@ var rootCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
-		err = client.Run(cfg)
+		err = client.Run(cfgFile, cfg)
 		return err
 	},
 }
 
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "show the status of a running nhole-client.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		addr := statusAddr
+		if addr == "" {
+			cfg, err := config.UnmarshalClientCfgByFile(cfgFile)
+			if err != nil {
+				return err
+			}
+			addr = cfg.StatusAddr
+		}
+		if addr == "" {
+			return fmt.Errorf("status_addr is not set in %s", cfgFile)
+		}
+		return client.PrintStatus(addr, statusJSON)
+	},
+}
+
 func main() {
 	err := rootCmd.Execute()
 	if err != nil {
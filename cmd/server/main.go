@@ -39,7 +39,7 @@ var rootCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
-		err = server.Run(cfg)
+		err = server.Run(cfgFile, cfg)
 		return err
 	},
 }
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/biandc/nhole/pkg/message"
+	"github.com/biandc/nhole/pkg/tools"
+)
+
+const (
+	// MaxTimeSkew is the largest accepted difference between the
+	// timestamp of a REGISTER message and the server clock.
+	MaxTimeSkew = 15 * time.Minute
+	// PreviousTokenGrace is how long a token replaced by SetToken is still
+	// accepted for forward connections.
+	PreviousTokenGrace = MaxTimeSkew
+)
+
+// Sign returns the hex encoded HMAC-SHA256 of timestamp and nonce keyed by token.
+func Sign(token string, timestamp int64, nonce string) (sign string) {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte(nonce))
+	sign = hex.EncodeToString(mac.Sum(nil))
+	return
+}
+
+// NewRegisterData builds the REGISTER message data for token, the token
+// itself never leaves the host.
+func NewRegisterData(token string, mux bool) (data string, err error) {
+	timestamp := time.Now().Unix()
+	nonce := tools.GenerateUUID()
+	data, err = message.MarshalRegisterData(timestamp, nonce, Sign(token, timestamp, nonce), mux)
+	return
+}
+
+var (
+	ErrData     = errors.New("authentication data error")
+	ErrExpired  = errors.New("authentication timestamp expired")
+	ErrMismatch = errors.New("authentication token mismatch")
+	ErrReplayed = errors.New("authentication nonce replayed")
+)
+
+type Verifier struct {
+	token string
+	// the replaced token, still accepted until previousExpire for the
+	// forward connections of clients that registered before a reload
+	previous       string
+	previousExpire time.Time
+	grace          time.Duration
+
+	nonces map[string]time.Time
+	sync.Mutex
+}
+
+func NewVerifier(token string) (v *Verifier) {
+	v = &Verifier{
+		token:  token,
+		grace:  PreviousTokenGrace,
+		nonces: make(map[string]time.Time, 0),
+	}
+	return
+}
+
+// SetToken replaces the token for the following registrations, the replaced
+// one is kept for the grace period of forward connections. An empty token is
+// never kept.
+func (v *Verifier) SetToken(token string) {
+	v.Lock()
+	defer v.Unlock()
+	if token == v.token {
+		return
+	}
+	v.previous, v.previousExpire = "", time.Time{}
+	if v.token != "" {
+		v.previous, v.previousExpire = v.token, time.Now().Add(v.grace)
+	}
+	v.token = token
+}
+
+// Verify checks the REGISTER message data and returns the token it was
+// signed with, an empty server token accepts everyone.
+func (v *Verifier) Verify(str string) (data *message.RegisterData, token string, err error) {
+	data, token, err = v.verify(str, v.tokens(false))
+	return
+}
+
+// VerifyForward is Verify for forward connections, which also accepts the
+// token replaced by SetToken during its grace period.
+func (v *Verifier) VerifyForward(str string) (data *message.RegisterData, token string, err error) {
+	data, token, err = v.verify(str, v.tokens(true))
+	return
+}
+
+// tokens returns the current token first, and the previous one if forward.
+func (v *Verifier) tokens(forward bool) (tokens []string) {
+	v.Lock()
+	defer v.Unlock()
+	tokens = []string{v.token}
+	if forward && v.previous != "" && time.Now().Before(v.previousExpire) {
+		tokens = append(tokens, v.previous)
+	}
+	return
+}
+
+func (v *Verifier) verify(str string, tokens []string) (data *message.RegisterData, token string, err error) {
+	data, err = message.UnmarshalRegisterData(str)
+	// only an empty current token accepts everyone
+	if tokens[0] == "" {
+		token = ""
+		if err != nil {
+			data, err = &message.RegisterData{}, nil
+		}
+		return
+	}
+	if err != nil {
+		err = ErrData
+		return
+	}
+	now := time.Now()
+	skew := now.Sub(time.Unix(data.Timestamp, 0))
+	if skew > MaxTimeSkew || skew < -MaxTimeSkew {
+		err = ErrExpired
+		return
+	}
+	matched := false
+	for _, token = range tokens {
+		if hmac.Equal([]byte(data.Sign), []byte(Sign(token, data.Timestamp, data.Nonce))) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		token = ""
+		err = ErrMismatch
+		return
+	}
+	v.Lock()
+	defer v.Unlock()
+	for nonce, expire := range v.nonces {
+		if now.After(expire) {
+			delete(v.nonces, nonce)
+		}
+	}
+	if _, ok := v.nonces[data.Nonce]; ok {
+		err = ErrReplayed
+		return
+	}
+	v.nonces[data.Nonce] = now.Add(2 * MaxTimeSkew)
+	return
+}
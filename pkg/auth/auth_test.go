@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/biandc/nhole/pkg/message"
+)
+
+func TestVerifier(t *testing.T) {
+	v := NewVerifier("secret")
+	data, err := NewRegisterData("secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = v.Verify(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = v.Verify(data); err == nil {
+		t.Fatal("replayed nonce accepted")
+	}
+	data, _ = NewRegisterData("other", false)
+	if _, _, err = v.Verify(data); err == nil {
+		t.Fatal("wrong token accepted")
+	}
+	timestamp := time.Now().Add(-2 * MaxTimeSkew).Unix()
+	data, _ = message.MarshalRegisterData(timestamp, "nonce", Sign("secret", timestamp, "nonce"), false)
+	if _, _, err = v.Verify(data); err == nil {
+		t.Fatal("expired timestamp accepted")
+	}
+	if _, _, err = v.Verify(""); err == nil {
+		t.Fatal("empty data accepted")
+	}
+}
+
+func TestVerifierSetToken(t *testing.T) {
+	v := NewVerifier("old")
+	v.SetToken("new")
+	data, _ := NewRegisterData("old", false)
+	if _, _, err := v.Verify(data); err == nil {
+		t.Fatal("replaced token accepted for a control connection")
+	}
+	data, _ = NewRegisterData("old", false)
+	if _, token, err := v.VerifyForward(data); err != nil || token != "old" {
+		t.Fatalf("VerifyForward token %q %v", token, err)
+	}
+	data, _ = NewRegisterData("new", false)
+	if _, _, err := v.Verify(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifierSetTokenFromEmpty(t *testing.T) {
+	v := NewVerifier("")
+	if _, _, err := v.VerifyForward(""); err != nil {
+		t.Fatal(err)
+	}
+	v.SetToken("x")
+	data, _ := NewRegisterData("other", false)
+	if _, _, err := v.VerifyForward(data); err == nil {
+		t.Fatal("any forward connection accepted after a reload from an empty token")
+	}
+	if _, _, err := v.VerifyForward(""); err == nil {
+		t.Fatal("empty data accepted after a reload from an empty token")
+	}
+	data, _ = NewRegisterData("x", false)
+	if _, _, err := v.VerifyForward(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifierRotate(t *testing.T) {
+	v := NewVerifier("a")
+	v.SetToken("b")
+	v.SetToken("c")
+	data, _ := NewRegisterData("a", false)
+	if _, _, err := v.VerifyForward(data); err == nil {
+		t.Fatal("token replaced twice accepted")
+	}
+	data, _ = NewRegisterData("b", false)
+	if _, token, err := v.VerifyForward(data); err != nil || token != "b" {
+		t.Fatalf("VerifyForward token %q %v", token, err)
+	}
+
+	v.grace = 0
+	v.SetToken("d")
+	data, _ = NewRegisterData("c", false)
+	if _, _, err := v.VerifyForward(data); err == nil {
+		t.Fatal("previous token accepted after the grace period")
+	}
+	data, _ = NewRegisterData("d", false)
+	if _, _, err := v.VerifyForward(data); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,21 +1,289 @@
 package config
 
 import (
+	"fmt"
+	"net"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/biandc/nhole/pkg/message"
 	"github.com/biandc/nhole/pkg/tools"
 	"gopkg.in/yaml.v3"
 )
 
+// AutoPort asks nhole-server to pick a free forward port, the same as 0.
+const AutoPort = "auto"
+
+const (
+	HealthCheckTCP  = "tcp"
+	HealthCheckHTTP = "http"
+)
+
 type Service struct {
-	Ip          string `yaml:"ip"`
-	Port        int    `yaml:"port"`
-	ForwardPort int    `yaml:"forward_port"`
+	Name          string   `yaml:"name"`
+	Ip            string   `yaml:"ip"`
+	Port          int      `yaml:"port"`
+	ForwardPort   int      `yaml:"forward_port"`
+	Protocol      string   `yaml:"protocol"`
+	CustomDomains []string `yaml:"custom_domains"`
+
+	// BandwidthLimit shapes each direction on nhole-server, such as 10MB
+	BandwidthLimit string `yaml:"bandwidth_limit"`
+	// UseCompression compresses the tunnel between nhole-client and nhole-server
+	UseCompression bool `yaml:"use_compression"`
+	// UseEncryption encrypts the tunnel with a key derived from the token
+	UseEncryption bool `yaml:"use_encryption"`
+	// MaxConnections bounds concurrent visitors on nhole-server, 0 is unlimited
+	MaxConnections int `yaml:"max_connections"`
+	// AllowIps and DenyIps filter visitors by ip or CIDR on nhole-server
+	AllowIps []string `yaml:"allow_ips"`
+	DenyIps  []string `yaml:"deny_ips"`
+	// SecretKey of a stcp or xtcp service, its visitors must know it
+	SecretKey string `yaml:"secret_key"`
+	// Group shares the forward port with the services of other clients
+	// that have the same Group and GroupKey
+	Group       string `yaml:"group"`
+	GroupKey    string `yaml:"group_key"`
+	LoadBalance string `yaml:"load_balance"`
+	// HealthCheck probes the local service, nhole-client closes the forward
+	// server while it is unhealthy
+	HealthCheck HealthCheck `yaml:"health_check"`
+}
+
+// UnmarshalYAML accepts forward_port: auto as 0.
+func (s *Service) UnmarshalYAML(value *yaml.Node) (err error) {
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		if value.Content[i].Value == "forward_port" && value.Content[i+1].Value == AutoPort {
+			value.Content[i+1].Value, value.Content[i+1].Tag = "0", "!!int"
+		}
+	}
+	type plain Service
+	err = value.Decode((*plain)(s))
+	return
+}
+
+func (s *Service) Validate() (err error) {
+	err = tools.ValidateIp(s.Ip)
+	if err != nil {
+		return
+	}
+	err = tools.ValidatePort(s.Port)
+	if err != nil {
+		return
+	}
+	err = tools.ValidatePort(s.ForwardPort)
+	if err != nil {
+		return
+	}
+	if s.Protocol == "" {
+		s.Protocol = message.TCP
+	}
+	err = message.ValidateProtocol(s.Protocol)
+	if err != nil {
+		return
+	}
+	_, err = tools.ParseBandwidth(s.BandwidthLimit)
+	if err != nil {
+		return
+	}
+	if s.MaxConnections < 0 {
+		err = fmt.Errorf("service %s max_connections %d is negative", s.Name, s.MaxConnections)
+		return
+	}
+	_, err = tools.ParseIPFilter(s.AllowIps, s.DenyIps)
+	if err != nil {
+		return
+	}
+	err = s.validateGroup()
+	if err != nil {
+		return
+	}
+	if s.HealthCheck.Type != "" && s.Protocol == message.UDP {
+		err = fmt.Errorf("service %s health_check does not support udp", s.Name)
+		return
+	}
+	err = s.HealthCheck.Validate()
+	if err != nil {
+		err = fmt.Errorf("service %s %s", s.Name, err.Error())
+		return
+	}
+	switch s.Protocol {
+	case message.STCP, message.XTCP:
+		if s.Name == "" || strings.ContainsAny(s.Name, "*:") {
+			err = fmt.Errorf("%s service name %q is empty or has * or :", s.Protocol, s.Name)
+			return
+		}
+		if s.SecretKey == "" {
+			err = fmt.Errorf("%s service %s secret_key is empty", s.Protocol, s.Name)
+			return
+		}
+		// stcp and xtcp services are not exposed on a port
+		s.ForwardPort = 0
+	case message.HTTP, message.HTTPS:
+		if len(s.CustomDomains) == 0 {
+			err = fmt.Errorf("service %s custom_domains is empty", s.Name)
+			return
+		}
+		if s.Name == "" {
+			s.Name = fmt.Sprintf("%s_%s", s.Protocol, s.CustomDomains[0])
+		}
+	default:
+		if s.Name == "" && s.ForwardPort == 0 {
+			s.Name = fmt.Sprintf("%s_%s_%d", s.Protocol, s.Ip, s.Port)
+		} else if s.Name == "" {
+			s.Name = fmt.Sprintf("%s_%d", s.Protocol, s.ForwardPort)
+		}
+	}
+	return
+}
+
+func (s *Service) validateGroup() (err error) {
+	if s.Group == "" {
+		if s.GroupKey != "" || s.LoadBalance != "" {
+			err = fmt.Errorf("service %s group_key and load_balance require group", s.Name)
+		}
+		return
+	}
+	if s.Protocol != message.TCP && s.Protocol != message.UDP {
+		err = fmt.Errorf("service %s group requires protocol tcp or udp", s.Name)
+		return
+	}
+	if s.LoadBalance == "" {
+		s.LoadBalance = message.RoundRobin
+	}
+	if s.LoadBalance != message.RoundRobin && s.LoadBalance != message.LeastConnections {
+		err = fmt.Errorf("service %s load_balance %s is not round_robin or least_connections", s.Name, s.LoadBalance)
+	}
+	return
+}
+
+// HealthCheck connects to the local service, or sends it a GET request, every
+// Interval. MaxFailed failures in a row make the service unhealthy, one
+// success makes it healthy again. An empty Type disables the health check.
+type HealthCheck struct {
+	Type      string        `yaml:"type"`
+	Path      string        `yaml:"path"`
+	Interval  time.Duration `yaml:"interval"`
+	Timeout   time.Duration `yaml:"timeout"`
+	MaxFailed int           `yaml:"max_failed"`
+}
+
+func (h *HealthCheck) Validate() (err error) {
+	switch h.Type {
+	case "":
+		return
+	case HealthCheckTCP:
+	case HealthCheckHTTP:
+		if h.Path == "" {
+			h.Path = "/"
+		}
+		if !strings.HasPrefix(h.Path, "/") {
+			err = fmt.Errorf("health_check path %s does not start with /", h.Path)
+			return
+		}
+	default:
+		err = fmt.Errorf("health_check type %s is not tcp or http", h.Type)
+		return
+	}
+	if h.Interval <= 0 {
+		h.Interval = 10 * time.Second
+	}
+	if h.Timeout <= 0 {
+		h.Timeout = 3 * time.Second
+	}
+	if h.MaxFailed <= 0 {
+		h.MaxFailed = 3
+	}
+	if h.Timeout > h.Interval {
+		err = fmt.Errorf("health_check timeout is greater than interval")
+	}
+	return
+}
+
+// Visitor listens on BindIp:BindPort and forwards to the stcp or xtcp
+// service ServerName of another nhole-client, a xtcp visitor tries a direct
+// udp connection before the relay of nhole-server.
+type Visitor struct {
+	Name       string `yaml:"name"`
+	Protocol   string `yaml:"protocol"`
+	ServerName string `yaml:"server_name"`
+	SecretKey  string `yaml:"secret_key"`
+	BindIp     string `yaml:"bind_ip"`
+	BindPort   int    `yaml:"bind_port"`
+}
+
+func (v *Visitor) Validate() (err error) {
+	if v.ServerName == "" || v.SecretKey == "" {
+		err = fmt.Errorf("visitor %s server_name and secret_key are required", v.Name)
+		return
+	}
+	if v.Name == "" {
+		v.Name = fmt.Sprintf("visitor_%s", v.ServerName)
+	}
+	if v.Protocol == "" {
+		v.Protocol = message.STCP
+	}
+	if v.Protocol != message.STCP && v.Protocol != message.XTCP {
+		err = fmt.Errorf("visitor %s protocol %s is not stcp or xtcp", v.Name, v.Protocol)
+		return
+	}
+	if v.BindIp == "" {
+		v.BindIp = "127.0.0.1"
+	}
+	err = tools.ValidateIp(v.BindIp)
+	if err != nil {
+		return
+	}
+	if v.BindPort == 0 {
+		err = fmt.Errorf("visitor %s bind_port is required", v.Name)
+		return
+	}
+	err = tools.ValidatePort(v.BindPort)
+	return
+}
+
+type Reconnect struct {
+	InitialInterval time.Duration `yaml:"initial_interval"`
+	MaxInterval     time.Duration `yaml:"max_interval"`
+	Multiplier      float64       `yaml:"multiplier"`
+	Jitter          float64       `yaml:"jitter"`
+}
+
+func (r *Reconnect) Validate() (err error) {
+	if r.InitialInterval <= 0 {
+		r.InitialInterval = 1 * time.Second
+	}
+	if r.MaxInterval <= 0 {
+		r.MaxInterval = 60 * time.Second
+	}
+	if r.Multiplier <= 0 {
+		r.Multiplier = 2
+	}
+	if r.MaxInterval < r.InitialInterval {
+		err = fmt.Errorf("reconnect max_interval is less than initial_interval")
+		return
+	}
+	if r.Multiplier < 1 {
+		err = fmt.Errorf("reconnect multiplier is less than 1")
+		return
+	}
+	if r.Jitter < 0 || r.Jitter > 1 {
+		err = fmt.Errorf("reconnect jitter is not in [0, 1]")
+	}
+	return
 }
 
 type ClientCfg struct {
-	Server   Server     `yaml:"server"`
-	Services []*Service `yaml:"service"`
+	Server    Server     `yaml:"server"`
+	Mux       bool       `yaml:"mux"`
+	PoolCount int        `yaml:"pool_count"`
+	Reconnect Reconnect  `yaml:"reconnect"`
+	Services  []*Service `yaml:"service"`
+	Visitors  []*Visitor `yaml:"visitor"`
+
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+	StatusAddr   string        `yaml:"status_addr"`
 }
 
 func (c *ClientCfg) Validate() (err error) {
@@ -27,25 +295,66 @@ func (c *ClientCfg) Validate() (err error) {
 	if err != nil {
 		return
 	}
+	err = c.Server.TLS.Validate()
+	if err != nil {
+		return
+	}
+	err = c.Reconnect.Validate()
+	if err != nil {
+		return
+	}
+	if c.DrainTimeout < 0 {
+		err = fmt.Errorf("drain_timeout %s is negative", c.DrainTimeout)
+		return
+	}
+	if c.PoolCount < 0 {
+		err = fmt.Errorf("pool_count %d is negative", c.PoolCount)
+		return
+	}
+	if c.StatusAddr != "" {
+		if _, _, err = net.SplitHostPort(c.StatusAddr); err != nil {
+			err = fmt.Errorf("status_addr %s", err.Error())
+			return
+		}
+	}
+	names := make(map[string]struct{}, len(c.Services))
 	for _, value := range c.Services {
-		err = tools.ValidateIp(value.Ip)
+		err = value.Validate()
 		if err != nil {
 			return
 		}
-		err = tools.ValidatePort(value.Port)
-		if err != nil {
+		if _, ok := names[value.Name]; ok {
+			err = fmt.Errorf("service name %s duplication", value.Name)
+			return
+		}
+		if value.UseEncryption && c.Server.Token == "" {
+			err = fmt.Errorf("service %s use_encryption requires server token", value.Name)
 			return
 		}
-		err = tools.ValidatePort(value.ForwardPort)
+		names[value.Name] = struct{}{}
+	}
+	visitorNames := make(map[string]struct{}, len(c.Visitors))
+	for _, value := range c.Visitors {
+		err = value.Validate()
 		if err != nil {
 			return
 		}
+		if _, ok := visitorNames[value.Name]; ok {
+			err = fmt.Errorf("visitor name %s duplication", value.Name)
+			return
+		}
+		visitorNames[value.Name] = struct{}{}
 	}
 	return
 }
 
 func UnmarshalClientCfg(content []byte) (cfg *ClientCfg, err error) {
-	cfg = &ClientCfg{}
+	cfg = &ClientCfg{
+		Reconnect: Reconnect{
+			Jitter: 0.2,
+		},
+		DrainTimeout: DefaultDrainTimeout,
+	}
 	err = yaml.Unmarshal(content, cfg)
 	if err != nil {
 		return
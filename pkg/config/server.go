@@ -1,19 +1,90 @@
 package config
 
 import (
+	"fmt"
+	"net"
 	"os"
+	"time"
 
 	"github.com/biandc/nhole/pkg/tools"
 	"gopkg.in/yaml.v3"
 )
 
+// DefaultDrainTimeout bounds how long a shutdown waits for forwarded connections.
+const DefaultDrainTimeout = 10 * time.Second
+
+// DefaultMaxPoolCount bounds the idle forward connections of a client.
+const DefaultMaxPoolCount = 5
+
+type TLS struct {
+	Enable             bool     `yaml:"enable"`
+	CertFile           string   `yaml:"cert_file"`
+	KeyFile            string   `yaml:"key_file"`
+	CaFile             string   `yaml:"ca_file"`
+	ServerName         string   `yaml:"server_name"`
+	Fingerprints       []string `yaml:"fingerprints"`
+	SelfSigned         bool     `yaml:"self_signed"`
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify"`
+}
+
+func (t *TLS) Validate() (err error) {
+	if !t.Enable {
+		return
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		err = fmt.Errorf("tls cert_file and key_file must be set together")
+	}
+	return
+}
+
 type Server struct {
 	Ip          string `yaml:"ip"`
 	ControlPort int    `yaml:"control_port"`
+	Token       string `yaml:"token"`
+	TLS         TLS    `yaml:"tls"`
+}
+
+// Admin is the admin http api of nhole-server, an empty addr disables it.
+type Admin struct {
+	Addr     string `yaml:"addr"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+}
+
+func (a *Admin) Validate() (err error) {
+	if a.Addr == "" {
+		return
+	}
+	_, _, err = net.SplitHostPort(a.Addr)
+	if err != nil {
+		err = fmt.Errorf("admin addr %s", err.Error())
+	}
+	return
 }
 
 type ServerCfg struct {
-	Server Server `yaml:"server"`
+	Server            Server `yaml:"server"`
+	VhostHttpPort     int    `yaml:"vhost_http_port"`
+	VhostHttpsPort    int    `yaml:"vhost_https_port"`
+	AllowPorts        string `yaml:"allow_ports"`
+	AutoPorts         string `yaml:"auto_ports"`
+	MaxPortsPerClient int    `yaml:"max_ports_per_client"`
+	// MaxPoolCount bounds the pool_count of a client, 0 disables the pools
+	MaxPoolCount int `yaml:"max_pool_count"`
+
+	// NatHolePort is the udp port that helps xtcp peers punch, 0 disables
+	NatHolePort int `yaml:"nat_hole_port"`
+
+	// MaxBandwidthPerClient shapes each direction of all services of a client
+	MaxBandwidthPerClient string `yaml:"max_bandwidth_per_client"`
+
+	// AllowIps and DenyIps filter the visitors of every forward server
+	AllowIps []string `yaml:"allow_ips"`
+	DenyIps  []string `yaml:"deny_ips"`
+
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+
+	Admin Admin `yaml:"admin"`
 }
 
 func (s *ServerCfg) Validate() (err error) {
@@ -22,11 +93,66 @@ func (s *ServerCfg) Validate() (err error) {
 		return
 	}
 	err = tools.ValidatePort(s.Server.ControlPort)
+	if err != nil {
+		return
+	}
+	if s.Server.TLS.Enable && !s.Server.TLS.SelfSigned && s.Server.TLS.CertFile == "" {
+		err = fmt.Errorf("tls cert_file and key_file are required without self_signed")
+		return
+	}
+	err = s.Server.TLS.Validate()
+	if err != nil {
+		return
+	}
+	err = tools.ValidatePort(s.VhostHttpPort)
+	if err != nil {
+		return
+	}
+	err = tools.ValidatePort(s.VhostHttpsPort)
+	if err != nil {
+		return
+	}
+	err = tools.ValidatePort(s.NatHolePort)
+	if err != nil {
+		return
+	}
+	_, err = tools.ParsePortRanges(s.AllowPorts)
+	if err != nil {
+		return
+	}
+	_, err = tools.ParsePortRanges(s.AutoPorts)
+	if err != nil {
+		return
+	}
+	if s.MaxPortsPerClient < 0 {
+		err = fmt.Errorf("max_ports_per_client %d is negative", s.MaxPortsPerClient)
+		return
+	}
+	if s.MaxPoolCount < 0 {
+		err = fmt.Errorf("max_pool_count %d is negative", s.MaxPoolCount)
+		return
+	}
+	_, err = tools.ParseBandwidth(s.MaxBandwidthPerClient)
+	if err != nil {
+		return
+	}
+	_, err = tools.ParseIPFilter(s.AllowIps, s.DenyIps)
+	if err != nil {
+		return
+	}
+	if s.DrainTimeout < 0 {
+		err = fmt.Errorf("drain_timeout %s is negative", s.DrainTimeout)
+		return
+	}
+	err = s.Admin.Validate()
 	return
 }
 
 func UnmarshalServerCfg(content []byte) (cfg *ServerCfg, err error) {
-	cfg = &ServerCfg{}
+	cfg = &ServerCfg{
+		MaxPoolCount: DefaultMaxPoolCount,
+		DrainTimeout: DefaultDrainTimeout,
+	}
 	err = yaml.Unmarshal(content, cfg)
 	if err != nil {
 		return
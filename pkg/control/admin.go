@@ -0,0 +1,377 @@
+package control
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/biandc/nhole/pkg/core"
+	"github.com/biandc/nhole/pkg/message"
+	"github.com/biandc/nhole/pkg/tools"
+)
+
+type ConnStatus struct {
+	ID         string    `json:"id"`
+	RemoteAddr string    `json:"remote_addr"`
+	StartTime  time.Time `json:"start_time"`
+}
+
+type ServerStatus struct {
+	ID            string       `json:"id"`
+	ClientID      string       `json:"client_id"`
+	Name          string       `json:"name"`
+	Protocol      string       `json:"protocol"`
+	Port          int          `json:"port"`
+	CustomDomains []string     `json:"custom_domains,omitempty"`
+	CreateTime    time.Time    `json:"create_time"`
+	Connections   []ConnStatus `json:"connections"`
+
+	BandwidthLimit int64 `json:"bandwidth_limit,omitempty"`
+	MaxConnections int   `json:"max_connections,omitempty"`
+	Rejected       int64 `json:"rejected_connections"`
+	Denied         int64 `json:"denied_connections"`
+
+	Group       string          `json:"group,omitempty"`
+	LoadBalance string          `json:"load_balance,omitempty"`
+	Members     []*MemberStatus `json:"members,omitempty"`
+}
+
+type MemberStatus struct {
+	ClientID    string `json:"client_id"`
+	ServerID    string `json:"server_id"`
+	Connections int    `json:"connections"`
+	Draining    bool   `json:"draining,omitempty"`
+}
+
+type ClientStatus struct {
+	ID            string          `json:"id"`
+	RemoteAddr    string          `json:"remote_addr"`
+	Mux           bool            `json:"mux"`
+	ConnectTime   time.Time       `json:"connect_time"`
+	LastHeartbeat time.Time       `json:"last_heartbeat"`
+	PoolCount     int             `json:"pool_count"`
+	Servers       []*ServerStatus `json:"servers"`
+}
+
+// clientInfo is what nhole-server knows about a connected control connection.
+type clientInfo struct {
+	remoteAddr    string
+	mux           bool
+	connectTime   time.Time
+	lastHeartbeat time.Time
+
+	// token the client registered with, keys encrypted streams
+	token string
+
+	// max_bandwidth_per_client shared by all services of the client
+	inLimiter  *tools.RateLimiter
+	outLimiter *tools.RateLimiter
+
+	// idle forward connections parked by pool_count
+	pool []*poolConn
+}
+
+// AdminServ serves the admin http api of nhole-server:
+//
+//	GET    /api/clients       connected clients with their forward servers
+//	GET    /api/clients/{id}
+//	DELETE /api/clients/{id}  kick the client
+//	GET    /api/servers       forward servers with their visitor connections
+//	GET    /api/servers/{id}
+//	DELETE /api/servers/{id}  close the forward server
+type AdminServ struct {
+	control  *ControlServ
+	user     string
+	password string
+
+	listener net.Listener
+	server   *http.Server
+}
+
+func NewAdminServer(control *ControlServ, addr, user, password string) (a *AdminServ, err error) {
+	var listener net.Listener
+	listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+	a = &AdminServ{
+		control:  control,
+		user:     user,
+		password: password,
+		listener: listener,
+	}
+	a.server = &http.Server{
+		Handler:           a.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if tcpAddr, ok := listener.Addr().(*net.TCPAddr); user == "" && password == "" && ok && !tcpAddr.IP.IsLoopback() {
+		control.logger.Warn("admin api %s has no user and password, anyone reaching it can kick clients", tcpAddr.String())
+	}
+	return
+}
+
+func (a *AdminServ) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/clients", a.handleClients)
+	mux.HandleFunc("/api/clients/", a.handleClients)
+	mux.HandleFunc("/api/servers", a.handleServers)
+	mux.HandleFunc("/api/servers/", a.handleServers)
+	mux.Handle("/metrics", a.control.metrics.registry)
+	return a.basicAuth(mux)
+}
+
+func (a *AdminServ) Addr() net.Addr {
+	return a.listener.Addr()
+}
+
+func (a *AdminServ) Serve() (err error) {
+	err = a.server.Serve(a.listener)
+	return
+}
+
+func (a *AdminServ) Close() (err error) {
+	err = a.server.Close()
+	return
+}
+
+// basicAuth requires the admin credentials when they are configured.
+func (a *AdminServ) basicAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.user != "" || a.password != "" {
+			user, password, ok := r.BasicAuth()
+			if !ok ||
+				subtle.ConstantTimeCompare([]byte(user), []byte(a.user)) != 1 ||
+				subtle.ConstantTimeCompare([]byte(password), []byte(a.password)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="nhole-server"`)
+				writeError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// pathID returns the {id} of prefix/{id}, or "" for prefix itself, a
+// deeper path is not ok.
+func pathID(path, prefix string) (id string, ok bool) {
+	id = strings.TrimPrefix(strings.TrimPrefix(path, prefix), "/")
+	ok = !strings.Contains(id, "/")
+	return
+}
+
+func (a *AdminServ) handleClients(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(r.URL.Path, "/api/clients")
+	switch {
+	case !ok:
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s not found", r.URL.Path))
+	case r.Method == http.MethodGet && id == "":
+		writeJSON(w, http.StatusOK, a.control.ClientStatuses())
+	case r.Method == http.MethodGet:
+		status, ok := a.control.ClientStatus(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("client %s not found", id))
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	case r.Method == http.MethodDelete && id != "":
+		if err := a.control.Kick(id); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"kicked": id})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (a *AdminServ) handleServers(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(r.URL.Path, "/api/servers")
+	switch {
+	case !ok:
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s not found", r.URL.Path))
+	case r.Method == http.MethodGet && id == "":
+		statuses := make([]*ServerStatus, 0)
+		for _, server := range a.control.controlRecord.getAll() {
+			statuses = append(statuses, server.Status())
+		}
+		sortServerStatuses(statuses)
+		writeJSON(w, http.StatusOK, statuses)
+	case r.Method == http.MethodGet:
+		server, err := a.control.controlRecord.GetByServerID(id)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, server.Status())
+	case r.Method == http.MethodDelete && id != "":
+		if err := a.control.CloseServer(id); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"closed": id})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func sortServerStatuses(statuses []*ServerStatus) {
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].CreateTime.Before(statuses[j].CreateTime)
+	})
+}
+
+func (c *ControlServ) addClient(clientID string, conn net.Conn, mux bool, token string) {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	c.clients[clientID] = &clientInfo{
+		remoteAddr:    conn.RemoteAddr().String(),
+		mux:           mux,
+		token:         token,
+		connectTime:   now,
+		lastHeartbeat: now,
+		inLimiter:     tools.NewRateLimiter(c.maxBandwidthPerClient),
+		outLimiter:    tools.NewRateLimiter(c.maxBandwidthPerClient),
+	}
+}
+
+func (c *ControlServ) getClientToken(clientID string) (token string, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+	client, ok := c.clients[clientID]
+	if ok {
+		token = client.token
+	}
+	return
+}
+
+func (c *ControlServ) delClient(clientID string) {
+	c.Lock()
+	info, ok := c.clients[clientID]
+	delete(c.clients, clientID)
+	c.Unlock()
+	if ok {
+		for _, pooled := range info.pool {
+			_ = pooled.Close()
+		}
+	}
+}
+
+func (c *ControlServ) touchClient(clientID string) {
+	c.Lock()
+	defer c.Unlock()
+	if info, ok := c.clients[clientID]; ok {
+		info.lastHeartbeat = time.Now()
+	}
+}
+
+func (c *ControlServ) ClientStatus(clientID string) (status *ClientStatus, ok bool) {
+	c.RLock()
+	info, ok := c.clients[clientID]
+	if ok {
+		status = &ClientStatus{
+			ID:            clientID,
+			RemoteAddr:    info.remoteAddr,
+			Mux:           info.mux,
+			ConnectTime:   info.connectTime,
+			LastHeartbeat: info.lastHeartbeat,
+			PoolCount:     len(info.pool),
+		}
+	}
+	c.RUnlock()
+	if !ok {
+		return
+	}
+	status.Servers = make([]*ServerStatus, 0)
+	for _, server := range c.controlRecord.GetByClientID(clientID) {
+		status.Servers = append(status.Servers, server.Status())
+	}
+	sortServerStatuses(status.Servers)
+	return
+}
+
+func (c *ControlServ) ClientStatuses() (statuses []*ClientStatus) {
+	c.RLock()
+	clientIDs := make([]string, 0, len(c.clients))
+	for clientID := range c.clients {
+		clientIDs = append(clientIDs, clientID)
+	}
+	c.RUnlock()
+	statuses = make([]*ClientStatus, 0, len(clientIDs))
+	for _, clientID := range clientIDs {
+		if status, ok := c.ClientStatus(clientID); ok {
+			statuses = append(statuses, status)
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].ConnectTime.Before(statuses[j].ConnectTime)
+	})
+	return
+}
+
+// Kick closes the control connection of clientID with all its forward servers.
+func (c *ControlServ) Kick(clientID string) (err error) {
+	var clienter net.Conn
+	clienter, err = c.clientRecord.Get(clientID)
+	if err != nil {
+		return
+	}
+	c.logger.Info("kick client %s", clientID)
+	err = clienter.Close()
+	return
+}
+
+// CloseServer closes one forward server and tells its client, for a group
+// only the member serverID is removed.
+func (c *ControlServ) CloseServer(serverID string) (err error) {
+	var (
+		server   *ForwardServ
+		clientID string
+		clienter net.Conn
+		data     string
+		msgBytes []byte
+	)
+	server, err = c.controlRecord.GetByServerID(serverID)
+	if err != nil {
+		return
+	}
+	clientID, ok := server.memberClientID(serverID)
+	if !ok {
+		err = fmt.Errorf("serverID %s not find in ControlRecord", serverID)
+		return
+	}
+	err = c.controlRecord.DelServer(clientID, serverID)
+	if err != nil {
+		return
+	}
+	c.logger.Info("close forward server %s %s", server.name, serverID)
+	clienter, err = c.clientRecord.Get(clientID)
+	if err != nil {
+		err = nil
+		return
+	}
+	data, _ = message.MarshalCloseServerData(&message.CloseServerData{
+		ServerID: serverID,
+		Name:     server.name,
+	})
+	msgBytes, _, _ = core.EncodeOneMsg(clientID, message.ControlConn, message.CloseForwardServer, 0, "", data)
+	_, _ = clienter.Write(msgBytes)
+	return
+}
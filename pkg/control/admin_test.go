@@ -0,0 +1,102 @@
+package control
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/biandc/nhole/pkg/log"
+)
+
+func newTestAdminServer(t *testing.T, user, password string) (a *AdminServ, c *ControlServ) {
+	c = &ControlServ{
+		controlRecord: NewControlRecord(),
+		clientRecord:  NewClientRecord(),
+		clients:       make(map[string]*clientInfo, 0),
+		logger:        log.New(),
+	}
+	c.metrics = newServerMetrics(c)
+	conn, peer := net.Pipe()
+	t.Cleanup(func() {
+		_ = peer.Close()
+	})
+	// the client reads CLOSE_FORWARD_SERVER
+	go func() {
+		_, _ = io.Copy(io.Discard, peer)
+	}()
+	c.addClient("c1", conn, false, "")
+	c.clientRecord.Add("c1", conn)
+	if err := c.controlRecord.Add("c1", "s1", newTestForwardServer(t, "c1", "s1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	a = &AdminServ{control: c, user: user, password: password}
+	return
+}
+
+func serveAdmin(a *AdminServ, method, path string) (w *httptest.ResponseRecorder) {
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(method, path, nil)
+	r.SetBasicAuth("admin", "pw")
+	a.handler().ServeHTTP(w, r)
+	return
+}
+
+func TestAdminServ(t *testing.T) {
+	a, c := newTestAdminServer(t, "admin", "pw")
+	for _, tc := range []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{http.MethodGet, "/api/clients", http.StatusOK},
+		{http.MethodGet, "/api/clients/c1", http.StatusOK},
+		{http.MethodGet, "/api/clients/c2", http.StatusNotFound},
+		{http.MethodGet, "/api/clients/c1/s1", http.StatusNotFound},
+		{http.MethodDelete, "/api/clients", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/api/servers", http.StatusOK},
+		{http.MethodGet, "/api/servers/s1", http.StatusOK},
+		{http.MethodGet, "/api/servers/s1/", http.StatusNotFound},
+		{http.MethodGet, "/metrics", http.StatusOK},
+	} {
+		if w := serveAdmin(a, tc.method, tc.path); w.Code != tc.code {
+			t.Fatalf("%s %s = %d, want %d", tc.method, tc.path, w.Code, tc.code)
+		}
+	}
+
+	var status ClientStatus
+	if err := json.Unmarshal(serveAdmin(a, http.MethodGet, "/api/clients/c1").Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.ID != "c1" || len(status.Servers) != 1 || status.Servers[0].ID != "s1" {
+		t.Fatalf("client status %+v", status)
+	}
+
+	if w := serveAdmin(a, http.MethodDelete, "/api/servers/s1"); w.Code != http.StatusOK {
+		t.Fatalf("close server = %d", w.Code)
+	}
+	if _, err := c.controlRecord.GetByServerID("s1"); err == nil {
+		t.Fatal("s1 not closed")
+	}
+	if w := serveAdmin(a, http.MethodDelete, "/api/clients/c1"); w.Code != http.StatusOK {
+		t.Fatalf("kick client = %d", w.Code)
+	}
+	conn, _ := c.clientRecord.Get("c1")
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Fatal("control connection of c1 not closed")
+	}
+}
+
+func TestAdminServAuth(t *testing.T) {
+	a, _ := newTestAdminServer(t, "admin", "secret")
+	w := serveAdmin(a, http.MethodGet, "/api/clients")
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("wrong password = %d", w.Code)
+	}
+	a, _ = newTestAdminServer(t, "", "")
+	if w = serveAdmin(a, http.MethodGet, "/api/clients"); w.Code != http.StatusOK {
+		t.Fatalf("without auth = %d", w.Code)
+	}
+}
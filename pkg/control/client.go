@@ -2,139 +2,522 @@ package control
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
+	"github.com/biandc/nhole/pkg/auth"
 	"github.com/biandc/nhole/pkg/config"
 	"github.com/biandc/nhole/pkg/core"
+	"github.com/biandc/nhole/pkg/core/mux"
 	"github.com/biandc/nhole/pkg/log"
 	"github.com/biandc/nhole/pkg/message"
+	"github.com/biandc/nhole/pkg/tools"
 )
 
 type ServiceInfo struct {
-	ip   string
-	port int
+	name          string
+	ip            string
+	port          int
+	forwardPort   int
+	protocol      string
+	customDomains []string
+
+	bandwidthLimit int64
+	useCompression bool
+	useEncryption  bool
+	maxConnections int
+	allowIps       []string
+	denyIps        []string
+	secretKey      string
+	group          string
+	groupKey       string
+	loadBalance    string
+	healthCheck    config.HealthCheck
+}
+
+func (s ServiceInfo) equal(other ServiceInfo) bool {
+	if s.name != other.name || s.ip != other.ip || s.port != other.port ||
+		s.forwardPort != other.forwardPort || s.protocol != other.protocol ||
+		s.bandwidthLimit != other.bandwidthLimit || s.useCompression != other.useCompression ||
+		s.useEncryption != other.useEncryption || s.maxConnections != other.maxConnections ||
+		s.secretKey != other.secretKey || s.group != other.group || s.groupKey != other.groupKey ||
+		s.loadBalance != other.loadBalance || s.healthCheck != other.healthCheck {
+		return false
+	}
+	return equalStrings(s.customDomains, other.customDomains) &&
+		equalStrings(s.allowIps, other.allowIps) && equalStrings(s.denyIps, other.denyIps)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
+func newServiceInfos(cfg *config.ClientCfg) (services map[string]ServiceInfo, err error) {
+	services = make(map[string]ServiceInfo, len(cfg.Services))
+	for _, service := range cfg.Services {
+		if _, ok := services[service.Name]; ok {
+			err = fmt.Errorf("config service name %s duplication", service.Name)
+			return
+		}
+		var bandwidthLimit int64
+		bandwidthLimit, err = tools.ParseBandwidth(service.BandwidthLimit)
+		if err != nil {
+			return
+		}
+		services[service.Name] = ServiceInfo{
+			name:          service.Name,
+			ip:            service.Ip,
+			port:          service.Port,
+			forwardPort:   service.ForwardPort,
+			protocol:      service.Protocol,
+			customDomains: service.CustomDomains,
+
+			bandwidthLimit: bandwidthLimit,
+			useCompression: service.UseCompression,
+			useEncryption:  service.UseEncryption,
+			maxConnections: service.MaxConnections,
+			allowIps:       service.AllowIps,
+			denyIps:        service.DenyIps,
+			secretKey:      service.SecretKey,
+			group:          service.Group,
+			groupKey:       service.GroupKey,
+			loadBalance:    service.LoadBalance,
+			healthCheck:    service.HealthCheck,
+		}
+	}
+	return
+}
+
+// closeAckTimeout bounds the wait for a CLOSE_FORWARD_SERVER acknowledgement.
+const closeAckTimeout = 5 * time.Second
+
+type ClientState string
+
+const (
+	StateDisconnected ClientState = "disconnected"
+	StateConnecting   ClientState = "connecting"
+	StateRegistered   ClientState = "registered"
+)
+
 type ControlClient struct {
-	ip   string
-	port int
+	ip        string
+	port      int
+	token     string
+	tlsConfig *tls.Config
+	mux       bool
+	poolCount int
+	cfgFile   string
+	reconnect config.Reconnect
 
-	clientID string
+	state        ClientState
+	errorInfo    string
+	backoff      *tools.Backoff
+	drainTimeout time.Duration
+	clientID     string
 	net.Conn
+	session *mux.Session
 
 	ctx    context.Context
 	logger *log.Logger
 
 	msgCh chan *message.Message
 
-	services map[int]ServiceInfo
+	services  map[string]ServiceInfo
+	serverIDs map[string]string
+	// forward ports assigned by nhole-server, keyed by service name
+	forwardPorts map[string]int
+	retries      map[string]*tools.Backoff
+	// CLOSE_FORWARD_SERVER waiting for the acknowledgement, keyed by server ID
+	closing       map[string]chan struct{}
+	serviceStates map[string]*serviceState
+	checkers      map[string]*healthChecker
+	status        *StatusServ
+	visitors      []*Visitor
+	metrics       *clientMetrics
+	heartbeatAt   time.Time
+
+	// idle forward connections parked on nhole-server, poolSlots also counts
+	// the ones being parked, up to pool_count
+	pool      map[net.Conn]struct{}
+	poolSlots int
 
 	clientRecord *clientRecord
 
+	done     chan struct{}
+	doneOnce sync.Once
 	sync.RWMutex
 }
 
 func NewControlClienter(ctx context.Context, ip string, port int) (c *ControlClient, err error) {
 	newCtx := ctx
 	cfg := ctx.Value("cfg").(*config.ClientCfg)
-	services := make(map[int]ServiceInfo, len(cfg.Services))
-	for _, service := range cfg.Services {
-		if _, ok := services[service.ForwardPort]; ok {
-			err = fmt.Errorf("config forward_port duplication")
-			return
-		}
-		services[service.ForwardPort] = ServiceInfo{
-			ip:   service.Ip,
-			port: service.Port,
-		}
+	cfgFile, _ := ctx.Value("cfgFile").(string)
+	services, err := newServiceInfos(cfg)
+	if err != nil {
+		return
+	}
+	tlsConfig, err := core.NewClientTlsConfig(&cfg.Server.TLS, ip)
+	if err != nil {
+		return
 	}
 	c = &ControlClient{
-		ip:   ip,
-		port: port,
+		ip:        ip,
+		port:      port,
+		token:     cfg.Server.Token,
+		tlsConfig: tlsConfig,
+		mux:       cfg.Mux,
+		poolCount: cfg.PoolCount,
+		cfgFile:   cfgFile,
+		reconnect: cfg.Reconnect,
 
-		clientID: "",
+		state:        StateDisconnected,
+		backoff:      newBackoff(cfg.Reconnect),
+		drainTimeout: cfg.DrainTimeout,
+		clientID:     "",
 
 		ctx:    newCtx,
 		logger: log.FromContextSafe(newCtx),
 
-		services: services,
+		services:     services,
+		serverIDs:    make(map[string]string, len(services)),
+		forwardPorts: make(map[string]int, len(services)),
+		retries:      make(map[string]*tools.Backoff, len(services)),
+		closing:      make(map[string]chan struct{}, 0),
+
+		serviceStates: make(map[string]*serviceState, len(services)),
+		checkers:      make(map[string]*healthChecker, 0),
+		pool:          make(map[net.Conn]struct{}, cfg.PoolCount),
 
 		clientRecord: NewClientRecord(),
+
+		done: make(chan struct{}),
+	}
+	for name := range services {
+		c.retries[name] = newBackoff(cfg.Reconnect)
+	}
+	c.metrics = newClientMetrics(c)
+	for _, visitorCfg := range cfg.Visitors {
+		var visitor *Visitor
+		visitor, err = NewVisitor(newCtx, visitorCfg, ip, port, cfg.Server.Token, tlsConfig)
+		if err != nil {
+			c.Release()
+			c = nil
+			return
+		}
+		c.visitors = append(c.visitors, visitor)
+	}
+	if cfg.StatusAddr != "" {
+		c.status, err = NewStatusServer(c, cfg.StatusAddr)
+		if err != nil {
+			c.Release()
+			c = nil
+			return
+		}
 	}
 	return
 }
 
+func newBackoff(reconnect config.Reconnect) *tools.Backoff {
+	return tools.NewBackoff(reconnect.InitialInterval, reconnect.MaxInterval, reconnect.Multiplier, reconnect.Jitter)
+}
+
+// Reload re-reads the config file and only closes or creates the forward
+// servers of the services that changed, other tunnels are kept.
+func (c *ControlClient) Reload() (err error) {
+	var (
+		cfg      *config.ClientCfg
+		services map[string]ServiceInfo
+	)
+	cfg, err = config.UnmarshalClientCfgByFile(c.cfgFile)
+	if err != nil {
+		return
+	}
+	services, err = newServiceInfos(cfg)
+	if err != nil {
+		return
+	}
+	if cfg.Server.Ip != c.ip || cfg.Server.ControlPort != c.port || cfg.Mux != c.mux {
+		c.logger.Warn("restart nhole-client to apply server and mux changes")
+	}
+	if !c.sameVisitors(cfg.Visitors) {
+		c.logger.Warn("restart nhole-client to apply visitor changes")
+	}
+	removed := make([]ServiceInfo, 0)
+	added := make([]ServiceInfo, 0)
+	c.Lock()
+	for name, service := range c.services {
+		if newService, ok := services[name]; !ok || !newService.equal(service) {
+			removed = append(removed, service)
+			delete(c.services, name)
+			delete(c.retries, name)
+			delete(c.serviceStates, name)
+			if checker, ok := c.checkers[name]; ok {
+				checker.Close()
+				delete(c.checkers, name)
+			}
+		}
+	}
+	for name, service := range services {
+		if _, ok := c.services[name]; !ok {
+			added = append(added, service)
+			c.services[name] = service
+			c.retries[name] = newBackoff(c.reconnect)
+		}
+	}
+	c.Unlock()
+	acks := make(map[string]<-chan struct{}, len(removed))
+	for _, service := range removed {
+		c.logger.Info("reload remove service %s", service.name)
+		acks[service.name] = c.closeServer(service.name)
+	}
+	for _, service := range added {
+		c.logger.Info("reload add service %s", service.name)
+		c.startHealthCheck(service)
+		ack, ok := acks[service.name]
+		if !ok || ack == nil {
+			c.sendCreateServer(service)
+			continue
+		}
+		// a changed service may reuse its forward port, create it once the
+		// old forward server is closed
+		go func(service ServiceInfo, ack <-chan struct{}) {
+			select {
+			case <-ack:
+			case <-time.After(closeAckTimeout):
+			}
+			if current, ok := c.getServiceByName(service.name); ok && current.equal(service) {
+				c.sendCreateServer(service)
+			}
+		}(service, ack)
+	}
+	return
+}
+
+// sameVisitors reports whether the reloaded visitor config matches the running visitors.
+func (c *ControlClient) sameVisitors(visitors []*config.Visitor) bool {
+	if len(visitors) != len(c.visitors) {
+		return false
+	}
+	for i, cfg := range visitors {
+		v := c.visitors[i]
+		if cfg.Name != v.name || cfg.Protocol != v.protocol || cfg.ServerName != v.serverName || cfg.SecretKey != v.secretKey ||
+			net.JoinHostPort(cfg.BindIp, strconv.Itoa(cfg.BindPort)) != v.Addr().String() {
+			return false
+		}
+	}
+	return true
+}
+
+// Serve keeps the client connected until Release, reconnecting with an
+// exponential backoff. The first retry after a lost connection is also
+// delayed so that a restarted nhole-server is not hit by every client at once.
+func (c *ControlClient) Serve() {
+	for _, service := range c.getServices() {
+		c.startHealthCheck(service)
+	}
+	for _, visitor := range c.visitors {
+		c.logger.Info("visitor %s listen %s", visitor.name, visitor.Addr().String())
+		go visitor.Run()
+	}
+	if c.status != nil {
+		go func() {
+			c.logger.Info("status api listen %s", c.status.Addr().String())
+			err := c.status.Serve()
+			c.logger.Warn("status api %s", err.Error())
+		}()
+	}
+	for {
+		c.setState(StateConnecting)
+		err := c.Init()
+		if err == nil {
+			c.setErrorInfo("")
+			c.backoff.Reset()
+			c.setState(StateRegistered)
+			c.Run()
+		} else {
+			c.setErrorInfo(err.Error())
+			c.logger.Error(err.Error())
+		}
+		c.setState(StateDisconnected)
+		c.metrics.reconnectAttempts.With().Inc()
+		d := c.backoff.Next()
+		c.logger.Info("reconnect to nhole-server in %s (attempt %d) ...", d, c.backoff.Attempts())
+		select {
+		case <-time.After(d):
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *ControlClient) setState(state ClientState) {
+	c.Lock()
+	old := c.state
+	c.state = state
+	c.Unlock()
+	if old != state {
+		c.logger.Info("state %s -> %s", old, state)
+	}
+}
+
+func (c *ControlClient) setErrorInfo(errorInfo string) {
+	c.Lock()
+	defer c.Unlock()
+	c.errorInfo = errorInfo
+}
+
+func (c *ControlClient) GetState() (state ClientState) {
+	c.RLock()
+	defer c.RUnlock()
+	state = c.state
+	return
+}
+
 func (c *ControlClient) Init() (err error) {
-	var conn net.Conn
-	conn, err = core.NewConner(c.ip, c.port)
+	var (
+		conn    net.Conn
+		control net.Conn
+		session *mux.Session
+		muxed   bool
+	)
+	conn, err = core.NewConner(c.ip, c.port, c.tlsConfig)
 	if err != nil {
 		return
 	}
 	conner := core.WrapConner(conn, 60*time.Second, nil)
-	msgCh := core.Decode2MsgCh(conner)
-	c.setConn(conner)
-	c.msgCh = msgCh
-	addr := c.RemoteAddr().String()
+	addr := conner.RemoteAddr().String()
 	c.logger.Info("connect to nhole-server %s ...", addr)
+	err = c.register(conner)
+	if err == nil {
+		muxed, err = c.handleRegister(conner)
+	}
+	if err != nil {
+		_ = conner.Close()
+		return
+	}
+	control = conner
+	if muxed {
+		session = mux.Client(conner)
+		control, err = session.OpenStream()
+		if err != nil {
+			_ = session.Close()
+			return
+		}
+		c.logger.Info("multiplexing streams over the control connection ...")
+	}
+	c.setConn(control, session)
+	c.msgCh = core.Decode2MsgCh(control)
 	c.logger.AppendPrefix(addr)
+	c.logger.AppendPrefix(c.getClientID())
 	return
 }
 
 func (c *ControlClient) Run() {
-	c.register()
+	c.createServer()
+	c.fillPool()
+	c.heartbeat()
+	if session := c.getSession(); session != nil {
+		go c.acceptStream(session)
+	}
 	c.handleData()
 }
 
-func (c *ControlClient) register() {
-	conn := c.getConn()
-	if conn == nil {
-		return
-	}
+func (c *ControlClient) register(conn net.Conn) (err error) {
 	var (
+		data     string
 		msgBytes []byte
 		msg      *message.Message
-		err      error
 	)
 	defer func() {
-		if err != nil {
-			c.logger.Error(err.Error())
-		} else {
+		if err == nil {
 			c.logger.Info("register send %s", msg.String())
 		}
 	}()
-	msgBytes, msg, err = core.EncodeOneMsg("", message.ControlConn, message.REGISTER, 0, "", "")
+	data, err = auth.NewRegisterData(c.token, c.mux)
 	if err != nil {
 		return
 	}
-	_, err = conn.Write(msgBytes)
-	if err == nil || strings.Contains(err.Error(), "use of closed network connection") {
-		err = nil
+	msgBytes, msg, err = core.EncodeOneMsg("", message.ControlConn, message.REGISTER, 0, "", data)
+	if err != nil {
+		return
 	}
+	_, err = conn.Write(msgBytes)
+	return
 }
 
-func (c *ControlClient) handleRegister(msg *message.Message) {
+func (c *ControlClient) handleRegister(conn net.Conn) (muxed bool, err error) {
+	var (
+		msg  *message.Message
+		data *message.RegisterResData
+	)
+	for {
+		msg, err = core.DecodeOneMsg(conn)
+		if err != nil {
+			return
+		}
+		if msg.Operation == message.REGISTER {
+			break
+		}
+	}
+	if msg.Error != 0 {
+		err = fmt.Errorf("register failed %s !!!", msg.ErrorInfo)
+		return
+	}
+	data, err = message.UnmarshalRegisterResData(msg.Data)
+	if err != nil {
+		return
+	}
+	muxed = c.mux && data.Mux
+	c.Lock()
 	c.clientID = msg.ClientID
-	c.logger.Info("set clientID %s ...", c.clientID)
-	c.logger.AppendPrefix(c.clientID)
-	c.createServer()
-	c.heartbeat()
+	c.Unlock()
+	c.logger.Info("set clientID %s ...", msg.ClientID)
+	return
+}
+
+func (c *ControlClient) acceptStream(session *mux.Session) {
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func(stream net.Conn) {
+			msg, err := core.DecodeOneMsg(stream)
+			if err != nil || msg.Operation != message.CreateForwardConn {
+				_ = stream.Close()
+				return
+			}
+			c.handleCreateConn(msg, stream)
+		}(stream)
+	}
 }
 
-func (c *ControlClient) handleCreateConn(msg *message.Message) {
+// handleCreateConn dials nhole-server for a new forward connection, or uses
+// stream when the control connection is multiplexed.
+func (c *ControlClient) handleCreateConn(msg *message.Message, stream net.Conn) {
 	var (
-		data        *message.CreateConnData
-		forwardPort int
-		clienter    *ForwardClient
-		err         error
+		data     *message.CreateConnData
+		clienter *ForwardClient
+		err      error
 	)
 	defer func() {
 		if err != nil {
 			log.Error("Error creating forwarding connection %s !!!", err.Error())
+			if stream != nil {
+				_ = stream.Close()
+			}
 		} else {
 			log.Info("Successfully created forwarding connection %s .", data.ForwardID)
 		}
@@ -145,95 +528,353 @@ func (c *ControlClient) handleCreateConn(msg *message.Message) {
 		if err != nil {
 			return
 		}
-		forwardPort, err = strconv.Atoi(data.ServerID)
-		if err != nil {
-			return
-		}
-		if localConnInfo, ok := c.services[forwardPort]; !ok {
-			err = fmt.Errorf("no local connection information found %d", forwardPort)
+		if localConnInfo, ok := c.getService(data.ServerID); !ok {
+			err = fmt.Errorf("no local connection information found %s", data.ServerID)
+		} else if localConnInfo.useEncryption && !data.Encryption {
+			// the request is not authenticated, never fall back to plaintext
+			err = fmt.Errorf("forwarding connection %s of %s is not encrypted", data.ForwardID, localConnInfo.name)
 		} else {
-			clienter, err = NewForwardClienter(
-				localConnInfo.ip,
-				localConnInfo.port,
-				c.ip,
-				c.port,
-				data.ServerID,
-				data.ForwardID,
-			)
+			if stream != nil {
+				clienter, err = NewForwardClienterByConn(
+					localConnInfo.ip,
+					localConnInfo.port,
+					localConnInfo.protocol,
+					stream,
+					c.token,
+					data,
+				)
+			} else {
+				clienter, err = NewForwardClienter(
+					localConnInfo.ip,
+					localConnInfo.port,
+					localConnInfo.protocol,
+					c.ip,
+					c.port,
+					c.token,
+					c.tlsConfig,
+					data,
+				)
+			}
 			if err != nil {
 				return
 			}
-			c.clientRecord.Add(clienter.clientID, clienter.controlConn)
-			if conner, ok := clienter.controlConn.(*core.Conn); ok {
-				conner.SetCloseFn(func() (err error) {
-					c.clientRecord.Del(clienter.clientID)
-					return
-				})
-			}
-			clienter.Run()
+			c.runForwardClient(localConnInfo, clienter)
 		}
 	default:
 		// PASS
 	}
 }
 
+// runForwardClient counts clienter as a connection of service until it closes.
+func (c *ControlClient) runForwardClient(service ServiceInfo, clienter *ForwardClient) {
+	clienter.inCounter = c.metrics.bytes.With(service.name, directionIn)
+	clienter.outCounter = c.metrics.bytes.With(service.name, directionOut)
+	c.clientRecord.Add(clienter.clientID, clienter.controlConn)
+	if conner, ok := clienter.controlConn.(*core.Conn); ok {
+		c.addServiceConn(service.name, 1)
+		conner.SetCloseFn(func() (err error) {
+			c.clientRecord.Del(clienter.clientID)
+			c.addServiceConn(service.name, -1)
+			return
+		})
+	}
+	clienter.Run()
+}
+
+// handleNatHole punches to a visitor of a xtcp service and forwards the
+// direct stream, encrypted with the secret key, to the local service. The
+// visitor falls back to nhole-server if punching fails.
+func (c *ControlClient) handleNatHole(msg *message.Message) {
+	var (
+		data     *message.NatHoleData
+		service  ServiceInfo
+		conn     net.Conn
+		clienter *ForwardClient
+		err      error
+	)
+	defer func() {
+		if err != nil {
+			c.logger.Warn("nat hole %s, the visitor falls back to nhole-server", err.Error())
+		} else {
+			c.logger.Info("nat hole to visitor %s of %s", conn.RemoteAddr().String(), service.name)
+		}
+	}()
+	data, err = message.UnmarshalNatHoleData(msg.Data)
+	if err != nil {
+		return
+	}
+	service, ok := c.getService(data.ServerID)
+	if !ok || service.protocol != message.XTCP {
+		err = fmt.Errorf("no local xtcp service found %s", data.ServerID)
+		return
+	}
+	conn, err = newNatHoleConn(c.ip, data.Port, message.ControlConn, data.Sid)
+	if err != nil {
+		return
+	}
+	connData := message.NewCreateConnData(data.ServerID, data.Sid)
+	connData.Encryption = true
+	connData.Salt = data.Sid
+	clienter, err = NewForwardClienterByConn(service.ip, service.port, message.TCP, conn, service.secretKey, connData)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	c.runForwardClient(service, clienter)
+}
+
 func (c *ControlClient) createServer() {
+	for _, service := range c.getServices() {
+		if retry, ok := c.getRetry(service.name); ok {
+			retry.Reset()
+		}
+		c.sendCreateServer(service)
+	}
+}
+
+// closeServer retracts the forward server of name from nhole-server, ack is
+// closed when nhole-server acknowledges or nil when nothing was created.
+func (c *ControlClient) closeServer(name string) (ack <-chan struct{}) {
+	serverID, ok := c.delServer(name)
+	if !ok {
+		return
+	}
+	ch := make(chan struct{})
+	c.Lock()
+	c.closing[serverID] = ch
+	c.Unlock()
+	c.sendCloseServer(serverID, name)
+	ack = ch
+	return
+}
+
+func (c *ControlClient) handleCloseServer(msg *message.Message) {
+	data, err := message.UnmarshalCloseServerData(msg.Data)
+	if err != nil {
+		c.logger.Error(err.Error())
+		return
+	}
+	c.Lock()
+	ch, acked := c.closing[data.ServerID]
+	if acked {
+		close(ch)
+		delete(c.closing, data.ServerID)
+	}
+	c.Unlock()
+	if !acked {
+		// closed on nhole-server, it stays closed until the next registration
+		if _, ok := c.getService(data.ServerID); ok {
+			c.delServer(data.Name)
+			c.setServiceState(data.Name, ServiceFailed, "closed by nhole-server")
+		}
+		c.logger.Warn("forwarding server %s closed by nhole-server", data.Name)
+		return
+	}
+	switch msg.Error {
+	case 0:
+		c.logger.Info("Successfully closed forwarding server %s.", data.Name)
+	default:
+		c.logger.Error("Failed to close forwarding server %s %s !!!", data.Name, msg.ErrorInfo)
+	}
+}
+
+// startHealthCheck runs the health check of service, if it has one.
+func (c *ControlClient) startHealthCheck(service ServiceInfo) {
+	if service.healthCheck.Type == "" {
+		return
+	}
+	checker := newHealthChecker(service, func(healthy bool, err error) {
+		c.handleHealthChange(service, healthy, err)
+	})
+	c.Lock()
+	c.checkers[service.name] = checker
+	c.Unlock()
+	go checker.Run()
+}
+
+// handleHealthChange closes the forward server of an unhealthy service and
+// creates it again once the service is healthy.
+func (c *ControlClient) handleHealthChange(service ServiceInfo, healthy bool, err error) {
+	// the service was changed or removed by a reload
+	if current, ok := c.getServiceByName(service.name); !ok || !current.equal(service) {
+		return
+	}
+	if !healthy {
+		c.logger.Warn("service %s is unhealthy %s, close its forwarding server", service.name, err.Error())
+		c.setServiceState(service.name, ServiceUnhealthy, err.Error())
+		c.closeServer(service.name)
+		return
+	}
+	c.logger.Info("service %s is healthy again, create its forwarding server", service.name)
+	if retry, ok := c.getRetry(service.name); ok {
+		retry.Reset()
+	}
+	c.sendCreateServer(service)
+}
+
+// isHealthy reports whether the health check of name passes, services
+// without health check are always healthy.
+func (c *ControlClient) isHealthy(name string) (healthy bool, err error) {
+	c.RLock()
+	checker, ok := c.checkers[name]
+	c.RUnlock()
+	if !ok {
+		return true, nil
+	}
+	healthy, err = checker.Healthy()
+	return
+}
+
+func (c *ControlClient) sendCloseServer(serverID, name string) {
 	conn := c.getConn()
 	if conn == nil {
 		return
 	}
-	for forwardPort := range c.services {
-		msgBytes, msg, err := core.EncodeOneMsg(
-			c.clientID,
-			message.ControlConn,
-			message.CreateForwardServer,
-			0,
-			"",
-			strconv.Itoa(forwardPort),
-		)
+	var (
+		data     string
+		msgBytes []byte
+		msg      *message.Message
+		err      error
+	)
+	defer func() {
 		if err != nil {
 			c.logger.Error(err.Error())
-			continue
+		} else {
+			c.logger.Info("closeServer send %s", msg.String())
 		}
-		_, err = conn.Write(msgBytes)
+	}()
+	data, err = message.MarshalCloseServerData(&message.CloseServerData{
+		ServerID: serverID,
+		Name:     name,
+	})
+	if err != nil {
+		return
+	}
+	msgBytes, msg, err = core.EncodeOneMsg(
+		c.getClientID(),
+		message.ControlConn,
+		message.CloseForwardServer,
+		0,
+		"",
+		data,
+	)
+	if err != nil {
+		return
+	}
+	_, err = conn.Write(msgBytes)
+}
+
+func (c *ControlClient) sendCreateServer(service ServiceInfo) {
+	if healthy, err := c.isHealthy(service.name); !healthy {
+		c.setServiceState(service.name, ServiceUnhealthy, err.Error())
+		return
+	}
+	conn := c.getConn()
+	if conn == nil {
+		return
+	}
+	var (
+		data     string
+		msgBytes []byte
+		msg      *message.Message
+		err      error
+	)
+	defer func() {
 		if err != nil {
+			c.setServiceState(service.name, ServiceFailed, err.Error())
 			c.logger.Error(err.Error())
 		} else {
 			c.logger.Info("createServer send %s", msg.String())
 		}
+	}()
+	c.setServiceState(service.name, ServicePending, "")
+	data, err = message.MarshalCreateServerData(&message.CreateServerData{
+		Name:          service.name,
+		ForwardPort:   service.forwardPort,
+		Protocol:      service.protocol,
+		CustomDomains: service.customDomains,
+
+		BandwidthLimit: service.bandwidthLimit,
+		UseCompression: service.useCompression,
+		UseEncryption:  service.useEncryption,
+		MaxConnections: service.maxConnections,
+		AllowIps:       service.allowIps,
+		DenyIps:        service.denyIps,
+		SecretKey:      service.secretKey,
+		Group:          service.group,
+		GroupKey:       service.groupKey,
+		LoadBalance:    service.loadBalance,
+	})
+	if err != nil {
+		return
 	}
+	msgBytes, msg, err = core.EncodeOneMsg(
+		c.getClientID(),
+		message.ControlConn,
+		message.CreateForwardServer,
+		0,
+		"",
+		data,
+	)
+	if err != nil {
+		return
+	}
+	_, err = conn.Write(msgBytes)
 }
 
 func (c *ControlClient) handleCreateServer(msg *message.Message) {
+	data, err := message.UnmarshalCreateServerData(msg.Data)
+	if err != nil {
+		c.logger.Error(err.Error())
+		return
+	}
+	service, ok := c.getServiceByName(data.Name)
+	if !ok {
+		c.logger.Error("no local service found %s", data.Name)
+		if msg.Error == 0 {
+			// removed by a reload while it was being created
+			c.sendCloseServer(data.ServerID, data.Name)
+		}
+		return
+	}
+	retry, ok := c.getRetry(data.Name)
+	if !ok {
+		return
+	}
 	switch msg.Error {
 	case 0:
-		c.logger.Info("Successfully created forwarding server %s.", msg.Data)
-	default:
-		c.logger.Error("Failed to create forwarding server %s %s !!!", msg.Data, msg.ErrorInfo)
-		// retry
-		conn := c.getConn()
-		if conn == nil {
+		retry.Reset()
+		if healthy, _ := c.isHealthy(data.Name); !healthy {
+			// turned unhealthy while it was being created
+			c.sendCloseServer(data.ServerID, data.Name)
 			return
 		}
-		time.Sleep(30 * time.Second)
-		msgBytes, msg, err := core.EncodeOneMsg(
-			c.clientID,
-			message.ControlConn,
-			message.CreateForwardServer,
-			0,
-			"",
-			msg.Data,
-		)
-		if err != nil {
-			c.logger.Error(err.Error())
-			return
-		}
-		_, err = conn.Write(msgBytes)
-		if err != nil {
-			c.logger.Error("%s  %s", conn.LocalAddr().String(), err.Error())
+		c.setServer(data.ServerID, data.Name, data.ForwardPort)
+		c.setServiceState(data.Name, ServiceActive, "")
+		if data.Protocol == message.STCP || data.Protocol == message.XTCP {
+			c.logger.Info("Successfully created %s forwarding server %s.", data.Protocol, data.Name)
 		} else {
-			c.logger.Info("createServer send %s", msg.String())
+			c.logger.Info("Successfully created forwarding server %s on %s:%d.", data.Name, c.ip, data.ForwardPort)
 		}
+	default:
+		c.setServiceState(data.Name, ServiceFailed, msg.ErrorInfo)
+		d := retry.Next()
+		c.logger.Error(
+			"Failed to create forwarding server %s %s, retry in %s (attempt %d) !!!",
+			msg.Data, msg.ErrorInfo, d, retry.Attempts(),
+		)
+		clientID := c.getClientID()
+		time.AfterFunc(d, func() {
+			// the connection was replaced, Run creates every server again
+			if c.getClientID() != clientID {
+				return
+			}
+			// the service was changed or removed by a reload
+			if current, ok := c.getServiceByName(service.name); !ok || !current.equal(service) {
+				return
+			}
+			c.sendCreateServer(service)
+		})
 	}
 }
 
@@ -251,10 +892,13 @@ func (c *ControlClient) heartbeat() {
 			c.logger.Error(err.Error())
 		}
 	}()
-	msgBytes, _, err = core.EncodeOneMsg(c.clientID, message.ControlConn, message.HEARTBEAT, 0, "", "")
+	msgBytes, _, err = core.EncodeOneMsg(c.getClientID(), message.ControlConn, message.HEARTBEAT, 0, "", "")
 	if err != nil {
 		return
 	}
+	c.Lock()
+	c.heartbeatAt = time.Now()
+	c.Unlock()
 	_, err = conn.Write(msgBytes)
 	if err != nil {
 		return
@@ -262,7 +906,16 @@ func (c *ControlClient) heartbeat() {
 }
 
 func (c *ControlClient) handleHeartbeat(_ interface{}) {
+	c.RLock()
+	rtt := time.Since(c.heartbeatAt)
+	c.RUnlock()
+	c.metrics.heartbeatRtt.Histogram().Observe(rtt.Seconds())
+	clientID := c.getClientID()
 	time.Sleep(30 * time.Second)
+	// a reconnected client runs its own heartbeat
+	if c.getClientID() != clientID {
+		return
+	}
 	c.heartbeat()
 }
 
@@ -272,8 +925,8 @@ func (c *ControlClient) handleData() {
 		c.clear()
 	}()
 	for msg := range c.msgCh {
-		if (msg.ConnType != message.ControlConn) ||
-			(c.clientID != "" && msg.ClientID != c.clientID) {
+		if clientID := c.getClientID(); (msg.ConnType != message.ControlConn) ||
+			(clientID != "" && msg.ClientID != clientID) {
 			c.logger.Error("connType error message %s", msg.String())
 			continue
 		}
@@ -281,18 +934,24 @@ func (c *ControlClient) handleData() {
 			c.logger.Info("message %s", msg.String())
 		}
 		switch msg.Operation {
-		case message.REGISTER:
-			// register
-			go c.handleRegister(msg)
 		case message.CreateForwardConn:
 			// create forward conn
-			go c.handleCreateConn(msg)
+			go c.handleCreateConn(msg, nil)
 		case message.CreateForwardServer:
 			// create forward server
 			go c.handleCreateServer(msg)
 		case message.HEARTBEAT:
 			// heartbeat
 			go c.handleHeartbeat(msg)
+		case message.CloseForwardServer:
+			// close forward server acknowledgement
+			go c.handleCloseServer(msg)
+		case message.NatHole:
+			// punch to a xtcp visitor
+			go c.handleNatHole(msg)
+		case message.SHUTDOWN:
+			// nhole-server is draining, reconnect once it closes the connection
+			c.logger.Warn("nhole-server is shutting down")
 		default:
 			// error
 			c.logger.Warn("error message %s", msg.String())
@@ -307,10 +966,89 @@ func (c *ControlClient) getConn() (conn net.Conn) {
 	return
 }
 
-func (c *ControlClient) setConn(conn net.Conn) {
+func (c *ControlClient) getClientID() (clientID string) {
+	c.RLock()
+	defer c.RUnlock()
+	clientID = c.clientID
+	return
+}
+
+func (c *ControlClient) getService(serverID string) (service ServiceInfo, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+	name, ok := c.serverIDs[serverID]
+	if !ok {
+		return
+	}
+	service, ok = c.services[name]
+	return
+}
+
+func (c *ControlClient) getServiceByName(name string) (service ServiceInfo, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+	service, ok = c.services[name]
+	return
+}
+
+func (c *ControlClient) getServices() (services []ServiceInfo) {
+	c.RLock()
+	defer c.RUnlock()
+	services = make([]ServiceInfo, 0, len(c.services))
+	for _, service := range c.services {
+		services = append(services, service)
+	}
+	return
+}
+
+func (c *ControlClient) getRetry(name string) (retry *tools.Backoff, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+	retry, ok = c.retries[name]
+	return
+}
+
+// delServer forgets the forward server of name and returns its server ID.
+func (c *ControlClient) delServer(name string) (serverID string, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	for key, value := range c.serverIDs {
+		if value == name {
+			serverID, ok = key, true
+			delete(c.serverIDs, key)
+			break
+		}
+	}
+	delete(c.forwardPorts, name)
+	return
+}
+
+func (c *ControlClient) setServer(serverID, name string, forwardPort int) {
+	c.Lock()
+	defer c.Unlock()
+	c.serverIDs[serverID] = name
+	c.forwardPorts[name] = forwardPort
+}
+
+func (c *ControlClient) GetForwardPort(name string) (forwardPort int, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+	forwardPort, ok = c.forwardPorts[name]
+	return
+}
+
+func (c *ControlClient) getSession() (session *mux.Session) {
+	c.RLock()
+	defer c.RUnlock()
+	session = c.session
+	return
+}
+
+func (c *ControlClient) setConn(conn net.Conn, session *mux.Session) {
 	c.Lock()
 	defer c.Unlock()
 	c.Conn = conn
+	c.session = session
 }
 
 func (c *ControlClient) clear() {
@@ -318,7 +1056,29 @@ func (c *ControlClient) clear() {
 	defer c.Unlock()
 	if c.Conn != nil {
 		_ = c.Close()
+		if c.session != nil {
+			_ = c.session.Close()
+			c.session = nil
+		}
 		c.clientID = ""
+		c.serverIDs = make(map[string]string, len(c.services))
+		c.forwardPorts = make(map[string]int, len(c.services))
+		for _, state := range c.serviceStates {
+			if state.state != ServiceUnhealthy {
+				state.state, state.errorInfo = ServicePending, ""
+			}
+		}
+		// nhole-server closes every forward server with the connection
+		for serverID, ch := range c.closing {
+			close(ch)
+			delete(c.closing, serverID)
+		}
+		// nhole-server closes the pool with the connection
+		for conn := range c.pool {
+			_ = conn.Close()
+		}
+		c.pool = make(map[net.Conn]struct{}, c.poolCount)
+		c.poolSlots = 0
 		c.msgCh = nil
 		c.Conn = nil
 		c.logger.ResetPrefixes()
@@ -326,6 +1086,50 @@ func (c *ControlClient) clear() {
 	}
 }
 
+// Shutdown stops reconnecting, tells nhole-server to send no more visitors and
+// waits up to drain_timeout for the forwarded connections before releasing them.
+func (c *ControlClient) Shutdown() (err error) {
+	c.doneOnce.Do(func() {
+		close(c.done)
+	})
+	defer c.Release()
+	if conn := c.getConn(); conn != nil {
+		msgBytes, _, _ := core.EncodeOneMsg(c.getClientID(), message.ControlConn, message.SHUTDOWN, 0, "", "")
+		_, _ = conn.Write(msgBytes)
+	}
+	timer := time.NewTimer(c.drainTimeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		active := c.clientRecord.Len()
+		if active == 0 {
+			c.logger.Info("all forwarded connections drained")
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-timer.C:
+			err = fmt.Errorf("drain timeout %s, force close %d forwarded connections", c.drainTimeout, active)
+			return
+		}
+	}
+}
+
 func (c *ControlClient) Release() {
+	c.doneOnce.Do(func() {
+		close(c.done)
+	})
+	if c.status != nil {
+		_ = c.status.Close()
+	}
+	for _, visitor := range c.visitors {
+		_ = visitor.Close()
+	}
+	c.RLock()
+	for _, checker := range c.checkers {
+		checker.Close()
+	}
+	c.RUnlock()
 	c.clear()
 }
@@ -2,23 +2,63 @@ package control
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
-	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/biandc/nhole/pkg/auth"
 	"github.com/biandc/nhole/pkg/core"
 	"github.com/biandc/nhole/pkg/log"
 	"github.com/biandc/nhole/pkg/message"
+	"github.com/biandc/nhole/pkg/tools"
 )
 
 type ForwardServ struct {
-	ip   string
-	port int
-
+	ip            string
+	port          int
+	protocol      string
+	name          string
+	customDomains []string
+	createTime    time.Time
+
+	// bandwidth_limit of the service, nil is unlimited
+	inLimiter  *tools.RateLimiter
+	outLimiter *tools.RateLimiter
+
+	compression bool
+	encryption  bool
+
+	// maxConnections bounds the visitors in record, 0 is unlimited
+	maxConnections int
+	rejected       int64
+	rejectCounter  core.Counter
+
+	// ipFilter of the service and serverFilter of nhole-server, nil allows everyone
+	ipFilter     *tools.IPFilter
+	serverFilter func() *tools.IPFilter
+	denied       int64
+	denyCounter  core.Counter
+
+	// secret of a stcp or xtcp service, visitors sign with it
+	secret *auth.Verifier
+
+	// clientID and serverID of the first member, which created the forward server
 	clientID string
 	serverID string
 
+	// group of nhole-clients sharing the forward server, members get the
+	// visitors by loadBalance
+	group       string
+	groupKey    string
+	loadBalance string
+	members     []*groupMember
+	next        int
+	// assigned is the member of each visitor
+	assigned map[string]*groupMember
+
 	net.Listener
 
 	ctx    context.Context
@@ -27,30 +67,81 @@ type ForwardServ struct {
 	connCh     chan net.Conn
 	createConn func(clientID, fserverID, forwardID string)
 
-	record map[string]net.Conn
+	record     map[string]net.Conn
+	startTimes map[string]time.Time
+	// visitors nhole-client has not paired yet, they are closed after pairTimeout
+	unpaired    map[string]struct{}
+	pairTimeout time.Duration
 	sync.RWMutex
 }
 
+// groupMember is a service of a nhole-client in the group of a forward server,
+// a forward server without group has itself as the only member.
+type groupMember struct {
+	clientID string
+	serverID string
+	conns    int
+	// draining members get no more visitors
+	draining bool
+}
+
+var (
+	// errMaxConnections rejects a visitor over max_connections of the service
+	errMaxConnections = fmt.Errorf("max_connections reached")
+	// errDraining rejects a visitor when every member of the group is draining
+	errDraining = fmt.Errorf("every member is draining")
+)
+
+// defaultPairTimeout closes a visitor that nhole-client does not pair in
+// time, such as when its local service is down.
+const defaultPairTimeout = 10 * time.Second
+
 func NewForwardServer(
 	ctx context.Context,
 	ip string,
 	port int,
+	protocol string,
 	clientID, serverID string,
 	createConn func(clientID, fserverID, forwardID string),
 ) (f *ForwardServ, err error) {
 	var listener net.Listener
-	listener, err = core.NewListener(ip, port)
+	switch protocol {
+	case message.UDP:
+		listener, err = core.NewUdpListener(ip, port)
+	default:
+		listener, err = core.NewListener(ip, port, nil)
+	}
 	if err != nil {
 		return
 	}
+	f = NewForwardServerByListener(ctx, listener, ip, port, protocol, clientID, serverID, createConn)
+	return
+}
+
+// NewForwardServerByListener serves visitors from listener, such as a
+// vhost listener shared with other forward servers.
+func NewForwardServerByListener(
+	ctx context.Context,
+	listener net.Listener,
+	ip string,
+	port int,
+	protocol string,
+	clientID, serverID string,
+	createConn func(clientID, fserverID, forwardID string),
+) (f *ForwardServ) {
 	newCtx := ctx
 	f = &ForwardServ{
-		ip:   ip,
-		port: port,
+		ip:         ip,
+		port:       port,
+		protocol:   protocol,
+		createTime: time.Now(),
 
 		clientID: clientID,
 		serverID: serverID,
 
+		members:  []*groupMember{{clientID: clientID, serverID: serverID}},
+		assigned: make(map[string]*groupMember, 0),
+
 		Listener: listener,
 
 		ctx:    newCtx,
@@ -59,12 +150,33 @@ func NewForwardServer(
 		connCh:     make(chan net.Conn, 100),
 		createConn: createConn,
 
-		record: make(map[string]net.Conn, 0),
+		record:     make(map[string]net.Conn, 0),
+		startTimes: make(map[string]time.Time, 0),
+		unpaired:   make(map[string]struct{}, 0),
+
+		pairTimeout: defaultPairTimeout,
 	}
 	f.logger.AppendPrefix(f.Addr().String())
 	return
 }
 
+// Port is the port visitors connect to, such as the one the system picked for port 0.
+func (f *ForwardServ) Port() (port int) {
+	if f.protocol == message.STCP || f.protocol == message.XTCP {
+		// visitors come through the control port
+		return
+	}
+	switch addr := f.Addr().(type) {
+	case *net.TCPAddr:
+		port = addr.Port
+	case *net.UDPAddr:
+		port = addr.Port
+	default:
+		port = f.port
+	}
+	return
+}
+
 func (f *ForwardServ) Run() {
 	go f.accept()
 	go f.HandleConn()
@@ -84,57 +196,313 @@ func (f *ForwardServ) accept() {
 
 func (f *ForwardServ) handleConn(conn net.Conn) {
 	addr := conn.RemoteAddr().String()
-	f.logger.Info("Connection from %s", addr)
-	f.Add(addr, conn)
-	f.createConn(f.clientID, strconv.Itoa(f.port), addr)
+	if !f.allowed(conn.RemoteAddr()) {
+		_ = conn.Close()
+		atomic.AddInt64(&f.denied, 1)
+		if f.denyCounter != nil {
+			f.denyCounter.Add(1)
+		}
+		f.logger.Warn("Deny %s by allow_ips and deny_ips", addr)
+		return
+	}
+	forwardID := tools.GenerateUUID()
+	fclient := core.WrapConner(conn, 0, func() (err error) {
+		f.Del(forwardID)
+		return
+	})
+	member, err := f.tryAdd(forwardID, fclient)
+	if err == errDraining {
+		_ = conn.Close()
+		f.logger.Warn("Reject %s, %s", addr, err.Error())
+		return
+	}
+	if err != nil {
+		_ = conn.Close()
+		rejected := atomic.AddInt64(&f.rejected, 1)
+		if f.rejectCounter != nil {
+			f.rejectCounter.Add(1)
+		}
+		f.logger.Warn("Reject %s, max_connections %d reached, %d rejected", addr, f.maxConnections, rejected)
+		return
+	}
+	f.logger.Info("Connection from %s %s", addr, forwardID)
+	time.AfterFunc(f.pairTimeout, func() {
+		if f.isUnpaired(forwardID) {
+			f.logger.Warn("Connection %s %s is not paired in %s", addr, forwardID, f.pairTimeout)
+			_ = fclient.Close()
+		}
+	})
+	f.createConn(member.clientID, member.serverID, forwardID)
 }
 
+func (f *ForwardServ) allowed(addr net.Addr) bool {
+	if f.serverFilter != nil && !f.serverFilter().AllowedAddr(addr) {
+		return false
+	}
+	return f.ipFilter.AllowedAddr(addr)
+}
+
+// HandleConn serves visitors until the listener is closed, the forwarded
+// connections are left to Close so that they can be drained.
 func (f *ForwardServ) HandleConn() {
-	defer func() {
-		err := f.Close()
-		if err != nil {
-			f.logger.Warn(err.Error())
-		} else {
-			f.logger.Info("Close.")
-		}
-	}()
+	defer f.logger.Info("Stop accepting.")
 	for conn := range f.connCh {
 		go f.handleConn(conn)
 	}
 }
 
+// Get returns the visitor fID to pair it with a forward connection.
 func (f *ForwardServ) Get(fID string) (fclient net.Conn, err error) {
 	var ok bool
-	f.RLock()
-	defer f.RUnlock()
+	f.Lock()
+	defer f.Unlock()
 	fclient, ok = f.record[fID]
 	if !ok {
 		err = fmt.Errorf("forwardServer %s not has %s", f.Addr().String(), fID)
+		return
 	}
+	delete(f.unpaired, fID)
 	return
 }
 
 func (f *ForwardServ) Add(fID string, fclient net.Conn) {
 	f.Lock()
 	defer f.Unlock()
+	f.add(fID, fclient)
+}
+
+func (f *ForwardServ) add(fID string, fclient net.Conn) {
 	f.record[fID] = fclient
+	f.startTimes[fID] = time.Now()
+	f.unpaired[fID] = struct{}{}
 }
 
-func (f *ForwardServ) clear() {
+// tryAdd is Add unless maxConnections visitors are recorded or no member
+// takes visitors, it assigns the visitor to a member.
+func (f *ForwardServ) tryAdd(fID string, fclient net.Conn) (member *groupMember, err error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.maxConnections > 0 && len(f.record) >= f.maxConnections {
+		err = errMaxConnections
+		return
+	}
+	member = f.pick()
+	if member == nil {
+		err = errDraining
+		return
+	}
+	f.add(fID, fclient)
+	member.conns++
+	f.assigned[fID] = member
+	return
+}
+
+// pick chooses the member of the next visitor, the caller holds the lock.
+func (f *ForwardServ) pick() (member *groupMember) {
+	n := len(f.members)
+	for i := 0; i < n; i++ {
+		candidate := f.members[(f.next+i)%n]
+		if candidate.draining {
+			continue
+		}
+		if member == nil || (f.loadBalance == message.LeastConnections && candidate.conns < member.conns) {
+			member = candidate
+		}
+		if f.loadBalance != message.LeastConnections {
+			break
+		}
+	}
+	f.next = (f.next + 1) % n
+	return
+}
+
+// addMember adds serverID of clientID to the group, unless every member is
+// draining and the listener is closed.
+func (f *ForwardServ) addMember(clientID, serverID string) (ok bool) {
+	f.Lock()
+	defer f.Unlock()
+	for _, member := range f.members {
+		if !member.draining {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return
+	}
+	f.members = append(f.members, &groupMember{clientID: clientID, serverID: serverID})
+	f.logger.Info("%s of %s joins group %s", serverID, clientID, f.group)
+	return
+}
+
+// removeMember closes the visitors of member serverID and reports how many
+// members are left, the forward server is closed with the last one.
+func (f *ForwardServ) removeMember(serverID string) (left int) {
+	conns := make([]net.Conn, 0)
+	f.Lock()
+	for i, member := range f.members {
+		if member.serverID != serverID {
+			continue
+		}
+		f.members = append(f.members[:i:i], f.members[i+1:]...)
+		for fID, assigned := range f.assigned {
+			if assigned == member {
+				conns = append(conns, f.record[fID])
+			}
+		}
+		break
+	}
+	left = len(f.members)
+	if left > 0 && f.serverID == serverID {
+		f.clientID, f.serverID = f.members[0].clientID, f.members[0].serverID
+	}
+	f.Unlock()
+	if left > 0 && f.group != "" {
+		f.logger.Info("%s leaves group %s, %d members left", serverID, f.group, left)
+	}
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+	return
+}
+
+// stopMember sends no more visitors to member serverID, the listener is
+// closed once every member is draining.
+func (f *ForwardServ) stopMember(serverID string) {
+	f.Lock()
+	draining := 0
+	for _, member := range f.members {
+		if member.serverID == serverID {
+			member.draining = true
+		}
+		if member.draining {
+			draining++
+		}
+	}
+	all := draining == len(f.members)
+	f.Unlock()
+	if all {
+		f.StopAccept()
+	}
+}
+
+// assignedClientID is the nhole-client of the member visitor fID is assigned to.
+func (f *ForwardServ) assignedClientID(fID string) (clientID string, ok bool) {
+	f.RLock()
+	defer f.RUnlock()
+	member, ok := f.assigned[fID]
+	if ok {
+		clientID = member.clientID
+	}
+	return
+}
+
+// memberClientID is the nhole-client of member serverID.
+func (f *ForwardServ) memberClientID(serverID string) (clientID string, ok bool) {
+	f.RLock()
+	defer f.RUnlock()
+	for _, member := range f.members {
+		if member.serverID == serverID {
+			return member.clientID, true
+		}
+	}
+	return
+}
+
+func (f *ForwardServ) isUnpaired(fID string) (ok bool) {
+	f.RLock()
+	defer f.RUnlock()
+	_, ok = f.unpaired[fID]
+	return
+}
+
+func (f *ForwardServ) Del(fID string) {
 	f.Lock()
 	defer f.Unlock()
-	for _, conn := range f.record {
+	if member, ok := f.assigned[fID]; ok {
+		member.conns--
+		delete(f.assigned, fID)
+	}
+	delete(f.record, fID)
+	delete(f.startTimes, fID)
+	delete(f.unpaired, fID)
+}
+
+// Status lists the forward server and its visitor connections.
+func (f *ForwardServ) Status() (status *ServerStatus) {
+	f.RLock()
+	defer f.RUnlock()
+	status = &ServerStatus{
+		ID:            f.serverID,
+		ClientID:      f.clientID,
+		Name:          f.name,
+		Protocol:      f.protocol,
+		Port:          f.Port(),
+		CustomDomains: f.customDomains,
+		CreateTime:    f.createTime,
+		Connections:   make([]ConnStatus, 0, len(f.record)),
+
+		MaxConnections: f.maxConnections,
+		Rejected:       atomic.LoadInt64(&f.rejected),
+		Denied:         atomic.LoadInt64(&f.denied),
+	}
+	if f.inLimiter != nil {
+		status.BandwidthLimit = f.inLimiter.Rate()
+	}
+	if f.group != "" {
+		status.Group = f.group
+		status.LoadBalance = f.loadBalance
+		status.Members = make([]*MemberStatus, 0, len(f.members))
+		for _, member := range f.members {
+			status.Members = append(status.Members, &MemberStatus{
+				ClientID:    member.clientID,
+				ServerID:    member.serverID,
+				Connections: member.conns,
+				Draining:    member.draining,
+			})
+		}
+	}
+	for fID, conn := range f.record {
+		status.Connections = append(status.Connections, ConnStatus{
+			ID:         fID,
+			RemoteAddr: conn.RemoteAddr().String(),
+			StartTime:  f.startTimes[fID],
+		})
+	}
+	return
+}
+
+func (f *ForwardServ) StopAccept() {
+	_ = f.Listener.Close()
+}
+
+func (f *ForwardServ) Active() (n int) {
+	f.RLock()
+	defer f.RUnlock()
+	n = len(f.record)
+	return
+}
+
+func (f *ForwardServ) clear() {
+	f.Lock()
+	record := f.record
+	f.record = make(map[string]net.Conn, 0)
+	f.startTimes = make(map[string]time.Time, 0)
+	f.unpaired = make(map[string]struct{}, 0)
+	for _, member := range f.assigned {
+		member.conns--
+	}
+	f.assigned = make(map[string]*groupMember, 0)
+	f.Unlock()
+	for _, conn := range record {
 		_ = conn.Close()
 	}
-	f.record = nil
 }
 
 func (f *ForwardServ) Close() (err error) {
 	f.clear()
-	err = f.Listener.Close()
-	if err != nil {
-		return
-	}
+	_ = f.Listener.Close()
+	f.logger.Info("Close.")
 	return
 }
 
@@ -145,19 +513,45 @@ type ForwardClient struct {
 
 	localIp     string
 	localPort   int
+	protocol    string
 	controlIp   string
 	controlPort int
+	token       string
 
 	localConn   net.Conn
 	controlConn net.Conn
+	// tunnel is controlConn with the negotiated encryption, compression
+	// and datagram framing
+	tunnel net.Conn
+
+	compression bool
+	encryption  bool
+	salt        string
+
+	// bytes from visitors and back to them, nil counts nothing
+	inCounter  core.Counter
+	outCounter core.Counter
+}
+
+func newLocalConner(ip string, port int, protocol string) (conn net.Conn, err error) {
+	switch protocol {
+	case message.UDP:
+		conn, err = core.NewUdpConner(ip, port)
+	default:
+		conn, err = core.NewConner(ip, port, nil)
+	}
+	return
 }
 
 func NewForwardClienter(
 	localIp string,
 	localPort int,
+	protocol string,
 	cIp string,
 	cPort int,
-	serverID, forwardID string,
+	token string,
+	tlsConfig *tls.Config,
+	data *message.CreateConnData,
 ) (f *ForwardClient, err error) {
 	var (
 		localConn   net.Conn
@@ -173,27 +567,31 @@ func NewForwardClienter(
 			}
 		}
 	}()
-	localConn, err = core.NewConner(localIp, localPort)
+	localConn, err = newLocalConner(localIp, localPort, protocol)
 	if err != nil {
 		return
 	}
-	controlConn, err = core.NewConner(cIp, cPort)
+	controlConn, err = core.NewConner(cIp, cPort, tlsConfig)
 	if err != nil {
 		return
 	}
 
 	f = &ForwardClient{
 		clientID:  "",
-		serverID:  serverID,
-		forwardID: forwardID,
+		serverID:  data.ServerID,
+		forwardID: data.ForwardID,
 
 		localIp:     localIp,
 		localPort:   localPort,
+		protocol:    protocol,
 		controlIp:   cIp,
 		controlPort: cPort,
+		token:       token,
 
 		localConn:   localConn,
 		controlConn: core.WrapConner(controlConn, 0, nil),
+		compression: data.Compression,
+		encryption:  data.Encryption,
 	}
 	err = f.register()
 	if err != nil {
@@ -203,6 +601,64 @@ func NewForwardClienter(
 	if err != nil {
 		return
 	}
+	err = f.newTunnel()
+	return
+}
+
+// NewForwardClienterByConn forwards over controlConn which is already
+// paired on nhole-server, such as a multiplexed stream.
+func NewForwardClienterByConn(
+	localIp string,
+	localPort int,
+	protocol string,
+	controlConn net.Conn,
+	token string,
+	data *message.CreateConnData,
+) (f *ForwardClient, err error) {
+	var localConn net.Conn
+	localConn, err = newLocalConner(localIp, localPort, protocol)
+	if err != nil {
+		return
+	}
+	f = &ForwardClient{
+		clientID:  tools.GenerateUUID(),
+		serverID:  data.ServerID,
+		forwardID: data.ForwardID,
+
+		localIp:   localIp,
+		localPort: localPort,
+		protocol:  protocol,
+		token:     token,
+
+		localConn:   localConn,
+		controlConn: core.WrapConner(controlConn, 0, nil),
+		compression: data.Compression,
+		encryption:  data.Encryption,
+		salt:        data.Salt,
+	}
+	err = f.newTunnel()
+	if err != nil {
+		_ = localConn.Close()
+	}
+	return
+}
+
+// newTunnel wraps controlConn, the order matches handleCreateConn of
+// nhole-server.
+func (f *ForwardClient) newTunnel() (err error) {
+	f.tunnel = f.controlConn
+	if f.encryption {
+		f.tunnel, err = core.WrapCryptoConner(f.tunnel, f.token, f.salt, true)
+		if err != nil {
+			return
+		}
+	}
+	if f.compression {
+		f.tunnel = core.WrapCompressConner(f.tunnel)
+	}
+	if f.protocol == message.UDP {
+		f.tunnel = core.WrapDatagramConner(f.tunnel)
+	}
 	return
 }
 
@@ -212,9 +668,14 @@ func (f *ForwardClient) Run() {
 
 func (f *ForwardClient) register() (err error) {
 	var (
+		data     string
 		msgBytes []byte
 	)
-	msgBytes, _, err = core.EncodeOneMsg("", message.ForwardConn, message.REGISTER, 0, "", "")
+	data, err = auth.NewRegisterData(f.token, false)
+	if err != nil {
+		return
+	}
+	msgBytes, _, err = core.EncodeOneMsg("", message.ForwardConn, message.REGISTER, 0, "", data)
 	if err != nil {
 		return
 	}
@@ -238,7 +699,17 @@ func (f *ForwardClient) handleRegister() (err error) {
 			break
 		}
 	}
+	if msg.Error != 0 {
+		err = fmt.Errorf("register failed %s", msg.ErrorInfo)
+		return
+	}
 	f.clientID = msg.ClientID
+	var data *message.RegisterResData
+	data, err = message.UnmarshalRegisterResData(msg.Data)
+	if err != nil {
+		return
+	}
+	f.salt = data.Salt
 	err = f.sendCreateConn()
 	return
 }
@@ -248,7 +719,10 @@ func (f *ForwardClient) sendCreateConn() (err error) {
 		data     string
 		msgBytes []byte
 	)
-	data, err = message.MarshalCreateConnData(f.serverID, f.forwardID)
+	connData := message.NewCreateConnData(f.serverID, f.forwardID)
+	connData.Compression = f.compression
+	connData.Encryption = f.encryption
+	data, err = message.MarshalCreateConnData(connData)
 	if err != nil {
 		return
 	}
@@ -261,5 +735,5 @@ func (f *ForwardClient) sendCreateConn() (err error) {
 }
 
 func (f *ForwardClient) forward() {
-	core.Forward(f.localConn, f.controlConn)
+	core.ForwardCount(f.localConn, f.tunnel, f.outCounter, f.inCounter)
 }
@@ -0,0 +1,108 @@
+package control
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/biandc/nhole/pkg/message"
+)
+
+func TestForwardServMaxConnections(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := make(chan string, 10)
+	f := NewForwardServerByListener(context.Background(), listener, "127.0.0.1", 0, message.TCP, "c1", "s1",
+		func(_, _, forwardID string) {
+			created <- forwardID
+		})
+	f.maxConnections = 1
+	f.pairTimeout = 200 * time.Millisecond
+	f.Run()
+	defer f.Close()
+
+	visitor := func() (conn net.Conn) {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return
+	}
+	closed := func(conn net.Conn) bool {
+		_, err := conn.Read(make([]byte, 1))
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return false
+		}
+		return err != nil
+	}
+
+	first := visitor()
+	<-created
+	// the second visitor is past max_connections
+	if second := visitor(); !closed(second) {
+		t.Fatal("visitor over max_connections not closed")
+	}
+	if rejected := atomic.LoadInt64(&f.rejected); rejected != 1 {
+		t.Fatalf("%d rejected", rejected)
+	}
+	// nhole-client never pairs the first one
+	start := time.Now()
+	if !closed(first) {
+		t.Fatal("unpaired visitor not closed")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("unpaired visitor closed after %s", d)
+	}
+	// the visitor is deleted right after its connection is closed
+	for i := 0; f.Active() != 0; i++ {
+		if i == 100 {
+			t.Fatalf("%d visitors recorded after the pair timeout", f.Active())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a paired visitor outlives the pair timeout
+	third := visitor()
+	if _, err = f.Get(<-created); err != nil {
+		t.Fatal(err)
+	}
+	_ = third.SetReadDeadline(time.Now().Add(2 * f.pairTimeout))
+	if closed(third) {
+		t.Fatal("paired visitor closed")
+	}
+}
+
+func TestForwardServDraining(t *testing.T) {
+	f := newTestForwardServer(t, "c1", "s1")
+	defer f.Close()
+	f.maxConnections = 1
+	f.members[0].draining = true
+	conn, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	visitor, err := f.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.tryAdd("f1", visitor); err != errDraining {
+		t.Fatalf("tryAdd with every member draining %v", err)
+	}
+	f.handleConn(visitor)
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("visitor of a draining group not closed")
+	}
+	// draining is not a max_connections rejection
+	if rejected := atomic.LoadInt64(&f.rejected); rejected != 0 {
+		t.Fatalf("%d rejected by max_connections", rejected)
+	}
+}
@@ -0,0 +1,127 @@
+package control
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/biandc/nhole/pkg/config"
+)
+
+// healthChecker probes a local service every interval and calls onChange when
+// the service turns unhealthy or healthy again.
+type healthChecker struct {
+	cfg        config.HealthCheck
+	addr       string
+	httpClient *http.Client
+
+	healthy  bool
+	failed   int
+	lastErr  error
+	onChange func(healthy bool, err error)
+	sync.RWMutex
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newHealthChecker(service ServiceInfo, onChange func(healthy bool, err error)) (h *healthChecker) {
+	h = &healthChecker{
+		cfg:  service.healthCheck,
+		addr: net.JoinHostPort(service.ip, strconv.Itoa(service.port)),
+		httpClient: &http.Client{
+			Timeout: service.healthCheck.Timeout,
+			// a redirect is an answer of a healthy service
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+
+		// a service is healthy until it fails max_failed checks
+		healthy:  true,
+		onChange: onChange,
+
+		done: make(chan struct{}),
+	}
+	return
+}
+
+func (h *healthChecker) Run() {
+	ticker := time.NewTicker(h.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		h.update(h.check())
+		select {
+		case <-ticker.C:
+		case <-h.done:
+			return
+		}
+	}
+}
+
+func (h *healthChecker) check() (err error) {
+	if h.cfg.Type == config.HealthCheckTCP {
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", h.addr, h.cfg.Timeout)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+		return
+	}
+	var resp *http.Response
+	resp, err = h.httpClient.Get("http://" + h.addr + h.cfg.Path)
+	if err != nil {
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		err = fmt.Errorf("health check %s status %d", h.cfg.Path, resp.StatusCode)
+	}
+	return
+}
+
+// update counts the failures in a row and reports the changes of health.
+func (h *healthChecker) update(err error) {
+	h.Lock()
+	changed := false
+	h.lastErr = err
+	if err == nil {
+		h.failed = 0
+		changed = !h.healthy
+		h.healthy = true
+	} else {
+		h.failed++
+		changed = h.healthy && h.failed >= h.cfg.MaxFailed
+		if changed {
+			h.healthy = false
+		}
+	}
+	healthy := h.healthy
+	h.Unlock()
+	select {
+	case <-h.done:
+		return
+	default:
+	}
+	if changed {
+		h.onChange(healthy, err)
+	}
+}
+
+// Healthy reports the health of the service and the error of the last check.
+func (h *healthChecker) Healthy() (healthy bool, err error) {
+	h.RLock()
+	defer h.RUnlock()
+	healthy, err = h.healthy, h.lastErr
+	return
+}
+
+func (h *healthChecker) Close() {
+	h.closeOnce.Do(func() {
+		close(h.done)
+	})
+}
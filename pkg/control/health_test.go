@@ -0,0 +1,88 @@
+package control
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/biandc/nhole/pkg/config"
+)
+
+func newTestService(t *testing.T, addr string, cfg config.HealthCheck) (service ServiceInfo) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.ip = host
+	service.port, _ = strconv.Atoi(port)
+	if err = cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	service.healthCheck = cfg
+	return
+}
+
+func TestHealthChecker(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	service := newTestService(t, addr, config.HealthCheck{Type: config.HealthCheckTCP, MaxFailed: 2})
+	changes := make([]bool, 0)
+	h := newHealthChecker(service, func(healthy bool, _ error) {
+		changes = append(changes, healthy)
+	})
+	defer h.Close()
+
+	h.update(h.check())
+	_ = listener.Close()
+	h.update(h.check())
+	if healthy, _ := h.Healthy(); !healthy {
+		t.Fatal("unhealthy after one failure")
+	}
+	h.update(h.check())
+	if healthy, err := h.Healthy(); healthy || err == nil {
+		t.Fatal("healthy after max_failed failures")
+	}
+	h.update(h.check())
+	listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	h.update(h.check())
+	if healthy, _ := h.Healthy(); !healthy {
+		t.Fatal("unhealthy after a success")
+	}
+	if len(changes) != 2 || changes[0] || !changes[1] {
+		t.Fatalf("health changes %v", changes)
+	}
+
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	service = newTestService(t, server.Listener.Addr().String(), config.HealthCheck{
+		Type:    config.HealthCheckHTTP,
+		Path:    "/health",
+		Timeout: time.Second,
+	})
+	h = newHealthChecker(service, func(bool, error) {})
+	defer h.Close()
+	if err = h.check(); err != nil {
+		t.Fatal(err)
+	}
+	status = http.StatusServiceUnavailable
+	if err = h.check(); err == nil {
+		t.Fatal("status 503 passed the health check")
+	}
+}
@@ -0,0 +1,108 @@
+package control
+
+import (
+	"errors"
+
+	"github.com/biandc/nhole/pkg/auth"
+	"github.com/biandc/nhole/pkg/metrics"
+)
+
+const (
+	directionIn  = "in"
+	directionOut = "out"
+)
+
+// serverMetrics are served on /metrics of the admin api, bytes "in" come from
+// visitors and bytes "out" go back to them.
+type serverMetrics struct {
+	registry         *metrics.Registry
+	bytes            *metrics.Vec
+	registerFailures *metrics.Vec
+	rejectedConns    *metrics.Vec
+	deniedConns      *metrics.Vec
+}
+
+func newServerMetrics(c *ControlServ) (m *serverMetrics) {
+	registry := metrics.NewRegistry()
+	registry.NewGaugeFunc("nhole_server_clients", "Connected nhole-clients.", func() float64 {
+		c.RLock()
+		defer c.RUnlock()
+		return float64(len(c.clients))
+	})
+	registry.NewGaugeFunc("nhole_server_forward_servers", "Open forward servers.", func() float64 {
+		return float64(len(c.controlRecord.getAll()))
+	})
+	registry.NewGaugeFunc("nhole_server_visitor_connections", "Active visitor connections.", func() float64 {
+		return float64(c.controlRecord.Active())
+	})
+	m = &serverMetrics{
+		registry: registry,
+		bytes: registry.NewCounter(
+			"nhole_server_bytes_total", "Bytes forwarded per service and direction.", "service", "direction"),
+		registerFailures: registry.NewCounter(
+			"nhole_server_register_failures_total", "Rejected registrations by reason.", "reason"),
+		rejectedConns: registry.NewCounter(
+			"nhole_server_rejected_connections_total", "Visitors rejected by max_connections per service.", "service"),
+		deniedConns: registry.NewCounter(
+			"nhole_server_denied_connections_total", "Visitors denied by allow_ips and deny_ips per service.", "service"),
+	}
+	return
+}
+
+func registerFailureReason(err error) string {
+	switch {
+	case errors.Is(err, auth.ErrData):
+		return "data"
+	case errors.Is(err, auth.ErrExpired):
+		return "expired"
+	case errors.Is(err, auth.ErrMismatch):
+		return "token"
+	case errors.Is(err, auth.ErrReplayed):
+		return "replayed"
+	default:
+		return "other"
+	}
+}
+
+// clientMetrics are served on /metrics of the status api, bytes "in" come from
+// visitors and bytes "out" go back to them.
+type clientMetrics struct {
+	registry          *metrics.Registry
+	bytes             *metrics.Vec
+	heartbeatRtt      *metrics.Vec
+	reconnectAttempts *metrics.Vec
+}
+
+func newClientMetrics(c *ControlClient) (m *clientMetrics) {
+	registry := metrics.NewRegistry()
+	registry.NewGaugeFunc("nhole_client_connected", "1 when registered on nhole-server.", func() float64 {
+		if c.GetState() == StateRegistered {
+			return 1
+		}
+		return 0
+	})
+	registry.NewGaugeFunc("nhole_client_active_services", "Services with an open forward server.", func() float64 {
+		c.RLock()
+		defer c.RUnlock()
+		n := 0
+		for _, state := range c.serviceStates {
+			if state.state == ServiceActive {
+				n++
+			}
+		}
+		return float64(n)
+	})
+	registry.NewGaugeFunc("nhole_client_visitor_connections", "Active visitor connections.", func() float64 {
+		return float64(c.clientRecord.Len())
+	})
+	m = &clientMetrics{
+		registry: registry,
+		bytes: registry.NewCounter(
+			"nhole_client_bytes_total", "Bytes forwarded per service and direction.", "service", "direction"),
+		heartbeatRtt: registry.NewHistogram(
+			"nhole_client_heartbeat_rtt_seconds", "Heartbeat round-trip time.", metrics.DefBuckets),
+		reconnectAttempts: registry.NewCounter(
+			"nhole_client_reconnect_attempts_total", "Attempts to reconnect to nhole-server."),
+	}
+	return
+}
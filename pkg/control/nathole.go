@@ -0,0 +1,226 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/biandc/nhole/pkg/core"
+	"github.com/biandc/nhole/pkg/core/rudp"
+	"github.com/biandc/nhole/pkg/log"
+	"github.com/biandc/nhole/pkg/message"
+)
+
+const (
+	// natHoleTimeout drops a session whose peers did not both probe in time
+	natHoleTimeout = 30 * time.Second
+	// natHoleProbeTimeout bounds the wait for the address of the peer
+	natHoleProbeTimeout  = 3 * time.Second
+	natHoleProbeInterval = 200 * time.Millisecond
+	// natHolePunchTimeout bounds the punching, the visitor then falls back
+	// to the relay of nhole-server
+	natHolePunchTimeout = 3 * time.Second
+)
+
+type natHoleSession struct {
+	visitorAddr *net.UDPAddr
+	clientAddr  *net.UDPAddr
+	createTime  time.Time
+}
+
+// NatHoleServ observes the public udp addresses of a xtcp visitor and the
+// nhole-client of the service, and tells each one the address of the other.
+type NatHoleServ struct {
+	*net.UDPConn
+
+	sessions map[string]*natHoleSession
+	sync.Mutex
+
+	ctx    context.Context
+	logger *log.Logger
+}
+
+func NewNatHoleServer(ctx context.Context, ip string, port int) (n *NatHoleServ, err error) {
+	var (
+		addr *net.UDPAddr
+		conn *net.UDPConn
+	)
+	addr, err = net.ResolveUDPAddr("udp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err != nil {
+		return
+	}
+	conn, err = net.ListenUDP("udp", addr)
+	if err != nil {
+		return
+	}
+	n = &NatHoleServ{
+		UDPConn: conn,
+
+		sessions: make(map[string]*natHoleSession, 0),
+
+		ctx:    ctx,
+		logger: log.FromContextSafe(ctx),
+	}
+	return
+}
+
+// Add accepts the probes of sid, only authenticated visitors get a session.
+func (n *NatHoleServ) Add(sid string) {
+	n.Lock()
+	defer n.Unlock()
+	now := time.Now()
+	for key, session := range n.sessions {
+		if now.Sub(session.createTime) > natHoleTimeout {
+			delete(n.sessions, key)
+		}
+	}
+	n.sessions[sid] = &natHoleSession{createTime: now}
+}
+
+func (n *NatHoleServ) Run() {
+	buf := make([]byte, 64*1024)
+	for {
+		size, addr, err := n.ReadFromUDP(buf)
+		if err != nil {
+			n.logger.Warn("nat hole %s", err.Error())
+			return
+		}
+		n.handleProbe(buf[:size], addr)
+	}
+}
+
+// handleProbe records the address of a probe and answers it once the peer
+// has probed too.
+func (n *NatHoleServ) handleProbe(b []byte, addr *net.UDPAddr) {
+	msg, err := core.DecodeOneMsg(bytes.NewReader(b))
+	if err != nil || msg.Operation != message.NatHole {
+		return
+	}
+	data, err := message.UnmarshalNatHoleData(msg.Data)
+	if err != nil {
+		return
+	}
+	var peer *net.UDPAddr
+	n.Lock()
+	session, ok := n.sessions[data.Sid]
+	if ok {
+		switch msg.ConnType {
+		case message.VisitorConn:
+			session.visitorAddr, peer = addr, session.clientAddr
+		case message.ControlConn:
+			session.clientAddr, peer = addr, session.visitorAddr
+		}
+	}
+	n.Unlock()
+	if peer == nil {
+		return
+	}
+	str, err := message.MarshalNatHoleData(&message.NatHoleData{
+		Sid:      data.Sid,
+		Addr:     addr.String(),
+		PeerAddr: peer.String(),
+	})
+	if err != nil {
+		return
+	}
+	msgBytes, _, err := core.EncodeOneMsg("", msg.ConnType, message.NatHole, 0, "", str)
+	if err != nil {
+		return
+	}
+	_, _ = n.WriteToUDP(msgBytes, addr)
+}
+
+// probeNatHole sends the probes of sid to nhole-server until it answers with
+// the public address of the peer.
+func probeNatHole(conn *net.UDPConn, server *net.UDPAddr, connType, sid string) (peer *net.UDPAddr, err error) {
+	var (
+		data     string
+		msgBytes []byte
+	)
+	defer func() {
+		_ = conn.SetReadDeadline(time.Time{})
+	}()
+	data, err = message.MarshalNatHoleData(&message.NatHoleData{Sid: sid})
+	if err != nil {
+		return
+	}
+	msgBytes, _, err = core.EncodeOneMsg("", connType, message.NatHole, 0, "", data)
+	if err != nil {
+		return
+	}
+	buf := make([]byte, 64*1024)
+	deadline := time.Now().Add(natHoleProbeTimeout)
+	for time.Now().Before(deadline) {
+		_, err = conn.WriteToUDP(msgBytes, server)
+		if err != nil {
+			return
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(natHoleProbeInterval))
+		for {
+			n, from, readErr := conn.ReadFromUDP(buf)
+			if errors.Is(readErr, os.ErrDeadlineExceeded) {
+				break
+			}
+			if readErr != nil {
+				err = readErr
+				return
+			}
+			if !from.IP.Equal(server.IP) || from.Port != server.Port {
+				continue
+			}
+			msg, decodeErr := core.DecodeOneMsg(bytes.NewReader(buf[:n]))
+			if decodeErr != nil || msg.Operation != message.NatHole {
+				continue
+			}
+			answer, decodeErr := message.UnmarshalNatHoleData(msg.Data)
+			if decodeErr != nil || answer.Sid != sid || answer.PeerAddr == "" {
+				continue
+			}
+			peer, err = net.ResolveUDPAddr("udp", answer.PeerAddr)
+			return
+		}
+	}
+	err = fmt.Errorf("nat hole probe timeout, no address of the peer")
+	return
+}
+
+// newNatHoleConn punches a direct udp path to the peer of sid with the help
+// of the nat hole server on serverIp:serverPort, and returns a reliable
+// stream over it.
+func newNatHoleConn(serverIp string, serverPort int, connType, sid string) (conn net.Conn, err error) {
+	var (
+		server  *net.UDPAddr
+		udpConn *net.UDPConn
+		peer    *net.UDPAddr
+		addr    net.Addr
+	)
+	server, err = net.ResolveUDPAddr("udp", net.JoinHostPort(serverIp, strconv.Itoa(serverPort)))
+	if err != nil {
+		return
+	}
+	udpConn, err = net.ListenUDP("udp", nil)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = udpConn.Close()
+		}
+	}()
+	peer, err = probeNatHole(udpConn, server, connType, sid)
+	if err != nil {
+		return
+	}
+	addr, err = rudp.Punch(udpConn, peer, sid, natHolePunchTimeout)
+	if err != nil {
+		return
+	}
+	conn = rudp.NewConn(udpConn, addr)
+	return
+}
@@ -0,0 +1,275 @@
+package control
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/biandc/nhole/pkg/auth"
+	"github.com/biandc/nhole/pkg/core"
+	"github.com/biandc/nhole/pkg/message"
+)
+
+const (
+	// poolRetryInterval delays replacing a pooled connection that was lost
+	// before it got a visitor.
+	poolRetryInterval = time.Second
+	// poolAckTimeout bounds the wait for nhole-client to acknowledge the
+	// visitor handed to a pooled connection, a write to a dead connection
+	// usually succeeds.
+	poolAckTimeout = 3 * time.Second
+)
+
+// poolConn is an idle forward connection parked on nhole-server by a
+// nhole-client with pool_count, it is registered and waits for a visitor.
+type poolConn struct {
+	net.Conn
+	// token and salt of its REGISTER key the encryption of the forward server
+	token string
+	salt  string
+}
+
+// handlePoolConn parks conner in the pool of the control connection
+// msg.ClientID, which must have registered with the same token.
+func (c *ControlServ) handlePoolConn(conner net.Conn, msg *message.Message, token, salt string) {
+	var (
+		msgBytes []byte
+		errInt   = 0
+		err      error
+	)
+	defer func() {
+		errInfo := ""
+		if err != nil {
+			errInfo = err.Error()
+			c.logger.Error("pool connection %s %s", conner.RemoteAddr().String(), errInfo)
+		}
+		msgBytes, _, _ = core.EncodeOneMsg(msg.ClientID, message.ForwardConn, message.PoolForwardConn, errInt, errInfo, "")
+		_, writeErr := conner.Write(msgBytes)
+		if err != nil || writeErr != nil {
+			_ = conner.Close()
+		}
+	}()
+	clientToken, ok := c.getClientToken(msg.ClientID)
+	if !ok || !hmac.Equal([]byte(clientToken), []byte(token)) {
+		err = fmt.Errorf("no control connection %s with the token", msg.ClientID)
+		errInt = 1
+		return
+	}
+	err = c.putPoolConn(msg.ClientID, &poolConn{Conn: conner, token: token, salt: salt})
+	if err != nil {
+		errInt = 2
+	}
+}
+
+func (c *ControlServ) putPoolConn(clientID string, pooled *poolConn) (err error) {
+	c.Lock()
+	defer c.Unlock()
+	info, ok := c.clients[clientID]
+	if !ok {
+		err = fmt.Errorf("no control connection %s", clientID)
+		return
+	}
+	if len(info.pool) >= c.maxPoolCount {
+		err = fmt.Errorf("client has reached max_pool_count %d", c.maxPoolCount)
+		return
+	}
+	info.pool = append(info.pool, pooled)
+	return
+}
+
+// getPoolConn takes the most recently parked connection of clientID.
+func (c *ControlServ) getPoolConn(clientID string) (pooled *poolConn, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	info, ok := c.clients[clientID]
+	if !ok || len(info.pool) == 0 {
+		ok = false
+		return
+	}
+	pooled = info.pool[len(info.pool)-1]
+	info.pool = info.pool[:len(info.pool)-1]
+	return
+}
+
+// createPoolConn hands the visitor of connData to pooled instead of asking
+// the client to dial a new forward connection, pooled is closed when the
+// client does not acknowledge it in poolAckTimeout.
+func (c *ControlServ) createPoolConn(pooled *poolConn, clientID string, connData *message.CreateConnData) (err error) {
+	var (
+		data     string
+		msgBytes []byte
+		msg      *message.Message
+	)
+	poolData := *connData
+	if poolData.Encryption {
+		poolData.Salt = pooled.salt
+	}
+	data, err = message.MarshalCreateConnData(&poolData)
+	if err != nil {
+		_ = pooled.Close()
+		return
+	}
+	msgBytes, msg, err = core.EncodeOneMsg(clientID, message.ForwardConn, message.CreateForwardConn, 0, "", data)
+	if err == nil {
+		_, err = pooled.Write(msgBytes)
+	}
+	if err == nil {
+		err = waitPoolAck(pooled)
+	}
+	if err != nil {
+		_ = pooled.Close()
+		return
+	}
+	c.handleCreateConn(pooled.Conn, msg, pooled.token, pooled.salt)
+	return
+}
+
+// waitPoolAck reads the POOL_FORWARD_CONN acknowledgement of a visitor handed
+// to pooled, the read timeout of the connection is longer than poolAckTimeout.
+func waitPoolAck(pooled *poolConn) (err error) {
+	var ack *message.Message
+	timer := time.AfterFunc(poolAckTimeout, func() {
+		_ = pooled.Close()
+	})
+	ack, err = core.DecodeOneMsg(pooled)
+	if !timer.Stop() {
+		err = fmt.Errorf("pool connection %s not acknowledged in %s", pooled.RemoteAddr().String(), poolAckTimeout)
+		return
+	}
+	if err != nil {
+		return
+	}
+	if ack.Operation != message.PoolForwardConn || ack.Error != 0 {
+		err = fmt.Errorf("pool connection %s unexpected acknowledgement %s", pooled.RemoteAddr().String(), ack.String())
+	}
+	return
+}
+
+// fillPool parks forward connections on nhole-server until pool_count of
+// them are idle or being parked, a multiplexed client opens streams instead.
+func (c *ControlClient) fillPool() {
+	c.Lock()
+	defer c.Unlock()
+	if c.Conn == nil || c.session != nil || c.clientID == "" {
+		return
+	}
+	for ; c.poolSlots < c.poolCount; c.poolSlots++ {
+		go c.runPoolConn(c.clientID)
+	}
+}
+
+// runPoolConn parks one forward connection for the control connection
+// clientID and forwards the visitor nhole-server hands to it.
+func (c *ControlClient) runPoolConn(clientID string) {
+	conn, err := c.newPoolConn(clientID)
+	var (
+		msg   *message.Message
+		retry = true
+	)
+	if err == nil {
+		msg, retry, err = c.waitPoolConn(conn)
+	}
+	c.Lock()
+	delete(c.pool, conn)
+	current := c.clientID == clientID
+	// a refused slot stays taken until the next control connection
+	if current && retry {
+		c.poolSlots--
+	}
+	c.Unlock()
+	if err != nil {
+		if conn != nil {
+			_ = conn.Close()
+		}
+		if !current {
+			return
+		}
+		c.logger.Warn("pool connection %s", err.Error())
+		if retry {
+			time.AfterFunc(poolRetryInterval, c.fillPool)
+		}
+		return
+	}
+	if current {
+		c.fillPool()
+	}
+	c.handleCreateConn(msg, conn)
+}
+
+// newPoolConn dials and registers a forward connection, then asks
+// nhole-server to park it for the control connection clientID.
+func (c *ControlClient) newPoolConn(clientID string) (conn net.Conn, err error) {
+	var (
+		data     string
+		msgBytes []byte
+		msg      *message.Message
+	)
+	conn, err = core.NewConner(c.ip, c.port, c.tlsConfig)
+	if err != nil {
+		return
+	}
+	data, err = auth.NewRegisterData(c.token, false)
+	if err != nil {
+		return
+	}
+	msgBytes, _, err = core.EncodeOneMsg("", message.ForwardConn, message.REGISTER, 0, "", data)
+	if err != nil {
+		return
+	}
+	_, err = conn.Write(msgBytes)
+	if err != nil {
+		return
+	}
+	msg, err = core.DecodeOneMsg(conn)
+	if err != nil {
+		return
+	}
+	if msg.Error != 0 {
+		err = fmt.Errorf("register failed %s", msg.ErrorInfo)
+		return
+	}
+	msgBytes, _, err = core.EncodeOneMsg(clientID, message.ForwardConn, message.PoolForwardConn, 0, "", "")
+	if err != nil {
+		return
+	}
+	c.Lock()
+	if c.clientID == clientID {
+		c.pool[conn] = struct{}{}
+	} else {
+		err = fmt.Errorf("control connection %s is closed", clientID)
+	}
+	c.Unlock()
+	if err != nil {
+		return
+	}
+	_, err = conn.Write(msgBytes)
+	return
+}
+
+// waitPoolConn waits for the visitor of the parked conn and acknowledges it,
+// a pool connection refused by nhole-server is not retried.
+func (c *ControlClient) waitPoolConn(conn net.Conn) (msg *message.Message, retry bool, err error) {
+	retry = true
+	for {
+		msg, err = core.DecodeOneMsg(conn)
+		if err != nil {
+			return
+		}
+		switch msg.Operation {
+		case message.PoolForwardConn:
+			if msg.Error != 0 {
+				err = fmt.Errorf("refused by nhole-server %s", msg.ErrorInfo)
+				retry = false
+				return
+			}
+		case message.CreateForwardConn:
+			var msgBytes []byte
+			msgBytes, _, err = core.EncodeOneMsg(msg.ClientID, message.ForwardConn, message.PoolForwardConn, 0, "", "")
+			if err == nil {
+				_, err = conn.Write(msgBytes)
+			}
+			return
+		}
+	}
+}
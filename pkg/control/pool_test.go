@@ -0,0 +1,71 @@
+package control
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/biandc/nhole/pkg/core"
+	"github.com/biandc/nhole/pkg/message"
+)
+
+func TestControlServPool(t *testing.T) {
+	c := &ControlServ{
+		maxPoolCount: 2,
+		clients:      map[string]*clientInfo{"c1": {}},
+	}
+	conns := make([]net.Conn, 0, 3)
+	for i := 0; i < 3; i++ {
+		conn, peer := net.Pipe()
+		defer peer.Close()
+		conns = append(conns, conn)
+		err := c.putPoolConn("c1", &poolConn{Conn: conn})
+		if (err == nil) != (i < 2) {
+			t.Fatalf("put %d %v", i, err)
+		}
+	}
+	if err := c.putPoolConn("c2", &poolConn{Conn: conns[2]}); err == nil {
+		t.Fatal("parked for an unknown client")
+	}
+	pooled, ok := c.getPoolConn("c1")
+	if !ok || pooled.Conn != conns[1] {
+		t.Fatal("the last parked connection is not taken first")
+	}
+	c.delClient("c1")
+	if _, err := conns[0].Write([]byte("x")); err == nil {
+		t.Fatal("pooled connection not closed with the client")
+	}
+	if _, ok = c.getPoolConn("c1"); ok {
+		t.Fatal("pool of a deleted client")
+	}
+}
+
+func TestWaitPoolAck(t *testing.T) {
+	for _, tc := range []struct {
+		operation string
+		ok        bool
+	}{
+		{message.PoolForwardConn, true},
+		{message.HEARTBEAT, false},
+		// a half dead connection never answers
+		{"", false},
+	} {
+		conn, peer := net.Pipe()
+		if tc.operation != "" {
+			go func(operation string) {
+				msgBytes, _, _ := core.EncodeOneMsg("c1", message.ForwardConn, operation, 0, "", "")
+				_, _ = peer.Write(msgBytes)
+			}(tc.operation)
+		}
+		start := time.Now()
+		err := waitPoolAck(&poolConn{Conn: conn})
+		if (err == nil) != tc.ok {
+			t.Fatalf("acknowledged by %q %v", tc.operation, err)
+		}
+		if d := time.Since(start); d > 2*poolAckTimeout {
+			t.Fatalf("acknowledgement waited %s", d)
+		}
+		_ = conn.Close()
+		_ = peer.Close()
+	}
+}
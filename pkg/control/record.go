@@ -39,6 +39,23 @@ func (c *clientRecord) GetAll() (conns []net.Conn) {
 	return
 }
 
+func (c *clientRecord) GetAllByID() (conns map[string]net.Conn) {
+	c.RLock()
+	defer c.RUnlock()
+	conns = make(map[string]net.Conn, len(c.clientMap))
+	for key, value := range c.clientMap {
+		conns[key] = value
+	}
+	return
+}
+
+func (c *clientRecord) Len() (n int) {
+	c.RLock()
+	defer c.RUnlock()
+	n = len(c.clientMap)
+	return
+}
+
 func (c *clientRecord) Add(clientID string, clienter net.Conn) {
 	c.Lock()
 	defer c.Unlock()
@@ -85,17 +102,42 @@ func (c *controlRecord) GetByServerID(serverID string) (server *ForwardServ, err
 	return
 }
 
-func (c *controlRecord) Add(clientID, serverID string, server *ForwardServ) {
+// Add records server for clientID unless the client already owns limit
+// servers, a limit of 0 means no limit.
+func (c *controlRecord) Add(clientID, serverID string, server *ForwardServ, limit int) (err error) {
 	c.Lock()
 	defer c.Unlock()
 	if c.clientServer == nil || c.serverMap == nil {
 		return
 	}
+	if limit > 0 && len(c.clientServer[clientID]) >= limit {
+		err = fmt.Errorf("client has reached max_ports_per_client %d", limit)
+		return
+	}
 	if _, ok := c.clientServer[clientID]; !ok {
 		c.clientServer[clientID] = make([]string, 0, 1)
 	}
 	c.clientServer[clientID] = append(c.clientServer[clientID], serverID)
 	c.serverMap[serverID] = server
+	return
+}
+
+// DelServer removes the forward server serverID of clientID and keeps the
+// others, a forward server is closed with the last member of its group.
+func (c *controlRecord) DelServer(clientID, serverID string) (err error) {
+	c.Lock()
+	defer c.Unlock()
+	serverIDs := c.clientServer[clientID]
+	for i, value := range serverIDs {
+		if value != serverID {
+			continue
+		}
+		c.clientServer[clientID] = append(serverIDs[:i:i], serverIDs[i+1:]...)
+		c.delServer(serverID)
+		return
+	}
+	err = fmt.Errorf("serverID %s not find in ControlRecord of %s", serverID, clientID)
+	return
 }
 
 func (c *controlRecord) Del(clientID string) {
@@ -103,11 +145,96 @@ func (c *controlRecord) Del(clientID string) {
 	defer c.Unlock()
 	if serverIDs, ok := c.clientServer[clientID]; ok {
 		for _, serverID := range serverIDs {
-			if server, ok := c.serverMap[serverID]; ok {
-				_ = server.Close()
-				delete(c.serverMap, serverID)
-			}
+			c.delServer(serverID)
 		}
 		delete(c.clientServer, clientID)
 	}
 }
+
+// delServer removes the member serverID from its forward server, the caller
+// holds the lock.
+func (c *controlRecord) delServer(serverID string) {
+	if server, ok := c.serverMap[serverID]; ok {
+		if server.removeMember(serverID) == 0 {
+			_ = server.Close()
+		}
+		delete(c.serverMap, serverID)
+	}
+}
+
+// getGroupServer returns the forward server of group.
+func (c *controlRecord) getGroupServer(group string) (server *ForwardServ, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+	for _, value := range c.serverMap {
+		if value.group == group {
+			return value, true
+		}
+	}
+	return
+}
+
+func (c *controlRecord) GetByClientID(clientID string) (servers []*ForwardServ) {
+	c.RLock()
+	defer c.RUnlock()
+	servers = make([]*ForwardServ, 0, len(c.clientServer[clientID]))
+	for _, serverID := range c.clientServer[clientID] {
+		if server, ok := c.serverMap[serverID]; ok {
+			servers = append(servers, server)
+		}
+	}
+	return
+}
+
+// getAll returns every forward server once, the members of a group share one.
+func (c *controlRecord) getAll() (servers []*ForwardServ) {
+	c.RLock()
+	defer c.RUnlock()
+	servers = make([]*ForwardServ, 0, len(c.serverMap))
+	seen := make(map[*ForwardServ]struct{}, len(c.serverMap))
+	for _, server := range c.serverMap {
+		if _, ok := seen[server]; ok {
+			continue
+		}
+		seen[server] = struct{}{}
+		servers = append(servers, server)
+	}
+	return
+}
+
+// StopAccept stops the forward servers of clientID from accepting visitors,
+// the other members of a group keep getting them.
+func (c *controlRecord) StopAccept(clientID string) {
+	c.RLock()
+	defer c.RUnlock()
+	for _, serverID := range c.clientServer[clientID] {
+		if server, ok := c.serverMap[serverID]; ok {
+			server.stopMember(serverID)
+		}
+	}
+}
+
+func (c *controlRecord) StopAcceptAll() {
+	for _, server := range c.getAll() {
+		server.StopAccept()
+	}
+}
+
+// Active counts the forwarded connections of every forward server.
+func (c *controlRecord) Active() (n int) {
+	for _, server := range c.getAll() {
+		n += server.Active()
+	}
+	return
+}
+
+func (c *controlRecord) Clear() {
+	servers := c.getAll()
+	c.Lock()
+	c.clientServer = make(map[string][]string, 0)
+	c.serverMap = make(map[string]*ForwardServ, 0)
+	c.Unlock()
+	for _, server := range servers {
+		_ = server.Close()
+	}
+}
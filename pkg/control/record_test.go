@@ -0,0 +1,132 @@
+package control
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/biandc/nhole/pkg/core"
+	"github.com/biandc/nhole/pkg/message"
+	"github.com/biandc/nhole/pkg/tools"
+)
+
+func newTestForwardServer(t *testing.T, clientID, serverID string) (f *ForwardServ) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f = NewForwardServerByListener(context.Background(), listener, "127.0.0.1", 0, message.TCP, clientID, serverID, nil)
+	return
+}
+
+func TestControlRecordDelServer(t *testing.T) {
+	record := NewControlRecord()
+	for _, serverID := range []string{"s1", "s2"} {
+		if err := record.Add("c1", serverID, newTestForwardServer(t, "c1", serverID), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := record.DelServer("c2", "s1"); err == nil {
+		t.Fatal("closed a forward server of another client")
+	}
+	if err := record.DelServer("c1", "s1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := record.GetByServerID("s1"); err == nil {
+		t.Fatal("s1 still recorded")
+	}
+	if _, err := record.GetByServerID("s2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := record.DelServer("c1", "s1"); err == nil {
+		t.Fatal("s1 closed twice")
+	}
+	record.Del("c1")
+	if _, err := record.GetByServerID("s2"); err == nil {
+		t.Fatal("s2 still recorded")
+	}
+}
+
+func TestControlRecordLimit(t *testing.T) {
+	record := NewControlRecord()
+	if err := record.Add("c1", "s1", newTestForwardServer(t, "c1", "s1"), 1); err != nil {
+		t.Fatal(err)
+	}
+	f := newTestForwardServer(t, "c1", "s2")
+	defer f.Close()
+	if err := record.Add("c1", "s2", f, 1); err == nil {
+		t.Fatal("max_ports_per_client exceeded")
+	}
+	record.Clear()
+}
+
+func TestControlRecordGroup(t *testing.T) {
+	record := NewControlRecord()
+	fserver := newTestForwardServer(t, "c1", "s1")
+	fserver.group = "web"
+	fserver.loadBalance = message.LeastConnections
+	if err := record.Add("c1", "s1", fserver, 0); err != nil {
+		t.Fatal(err)
+	}
+	fserver.addMember("c2", "s2")
+	if err := record.Add("c2", "s2", fserver, 0); err != nil {
+		t.Fatal(err)
+	}
+	if servers := record.getAll(); len(servers) != 1 {
+		t.Fatalf("got %d forward servers for one group", len(servers))
+	}
+
+	picked := make(map[string]int)
+	for _, fID := range []string{"f1", "f2", "f3", "f4"} {
+		fID := fID
+		conn, _ := net.Pipe()
+		member, err := fserver.tryAdd(fID, core.WrapConner(conn, 0, func() (err error) {
+			fserver.Del(fID)
+			return
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked[member.clientID]++
+	}
+	if picked["c1"] != 2 || picked["c2"] != 2 {
+		t.Fatalf("least connections picked %v", picked)
+	}
+
+	record.Del("c1")
+	if clientID, ok := fserver.memberClientID("s2"); !ok || clientID != "c2" {
+		t.Fatal("member c2 removed with c1")
+	}
+	if fserver.clientID != "c2" || fserver.Active() != 2 {
+		t.Fatalf("forward server of %s with %d visitors", fserver.clientID, fserver.Active())
+	}
+	record.Del("c2")
+	if _, err := record.GetByServerID("s2"); err == nil {
+		t.Fatal("s2 still recorded")
+	}
+}
+
+func TestControlServGroupLimiters(t *testing.T) {
+	fserver := newTestForwardServer(t, "c1", "s1")
+	fserver.group = "web"
+	fserver.addMember("c2", "s2")
+	c := &ControlServ{clients: map[string]*clientInfo{
+		"c1": {inLimiter: tools.NewRateLimiter(1024), outLimiter: tools.NewRateLimiter(1024)},
+		"c2": {inLimiter: tools.NewRateLimiter(2048), outLimiter: tools.NewRateLimiter(2048)},
+	}}
+	for _, clientID := range []string{"c1", "c2"} {
+		fID := "f_" + clientID
+		conn, _ := net.Pipe()
+		member, err := fserver.tryAdd(fID, conn)
+		if err != nil || member.clientID != clientID {
+			t.Fatalf("visitor %s not assigned to %s", fID, clientID)
+		}
+		in, out := c.getLimiters(fserver, fID)
+		if len(in) != 1 || len(out) != 1 || in[0] != c.clients[clientID].inLimiter || out[0] != c.clients[clientID].outLimiter {
+			t.Fatalf("visitor of %s got limiters %v %v", clientID, in, out)
+		}
+	}
+	if in, _ := c.getLimiters(fserver, "unknown"); len(in) != 0 {
+		t.Fatal("client limiter of an unassigned visitor")
+	}
+}
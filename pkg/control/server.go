@@ -2,24 +2,64 @@ package control
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
 	"net"
-	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/biandc/nhole/pkg/auth"
+	"github.com/biandc/nhole/pkg/config"
 	"github.com/biandc/nhole/pkg/core"
+	"github.com/biandc/nhole/pkg/core/mux"
+	"github.com/biandc/nhole/pkg/core/vhost"
 	"github.com/biandc/nhole/pkg/log"
 	"github.com/biandc/nhole/pkg/message"
 	"github.com/biandc/nhole/pkg/tools"
 )
 
 type ControlServ struct {
-	ip   string
-	port int
+	ip      string
+	port    int
+	cfg     *config.ServerCfg
+	cfgFile string
 
 	controlRecord *controlRecord
 	clientRecord  *clientRecord
 
+	verifier *auth.Verifier
+
+	allowPorts        tools.PortRanges
+	autoPorts         tools.PortRanges
+	maxPortsPerClient int
+	maxPoolCount      int
+
+	maxBandwidthPerClient int64
+
+	ipFilter *tools.IPFilter
+
+	drainTimeout time.Duration
+	shutting     int32
+
+	// groupLock orders the services joining a group
+	groupLock sync.Mutex
+
+	sync.RWMutex
+
 	net.Listener
+	httpMuxer  *vhost.HttpMuxer
+	httpsMuxer *vhost.HttpsMuxer
+	// stcpRouter maps stcp and xtcp service names to their forward servers
+	stcpRouter *vhost.Router
+	natHole    *NatHoleServ
+	admin      *AdminServ
+	metrics    *serverMetrics
+
+	clients map[string]*clientInfo
 
 	ctx    context.Context
 	logger *log.Logger
@@ -28,25 +68,120 @@ type ControlServ struct {
 }
 
 func NewControlServer(ctx context.Context, ip string, port int) (c *ControlServ, err error) {
-	var listener net.Listener
-	listener, err = core.NewListener(ip, port)
+	var (
+		listener  net.Listener
+		tlsConfig *tls.Config
+	)
+	cfg := ctx.Value("cfg").(*config.ServerCfg)
+	tlsConfig, err = core.NewServerTlsConfig(&cfg.Server.TLS)
+	if err != nil {
+		return
+	}
+	allowPorts, err := tools.ParsePortRanges(cfg.AllowPorts)
+	if err != nil {
+		return
+	}
+	autoPorts, err := tools.ParsePortRanges(cfg.AutoPorts)
+	if err != nil {
+		return
+	}
+	if len(autoPorts) == 0 {
+		autoPorts = allowPorts
+	}
+	maxBandwidthPerClient, err := tools.ParseBandwidth(cfg.MaxBandwidthPerClient)
+	if err != nil {
+		return
+	}
+	ipFilter, err := tools.ParseIPFilter(cfg.AllowIps, cfg.DenyIps)
+	if err != nil {
+		return
+	}
+	listener, err = core.NewListener(ip, port, tlsConfig)
 	if err != nil {
 		return
 	}
+	var httpMuxer *vhost.HttpMuxer
+	if cfg.VhostHttpPort > 0 {
+		var httpListener net.Listener
+		httpListener, err = core.NewListener(ip, cfg.VhostHttpPort, nil)
+		if err != nil {
+			_ = listener.Close()
+			return
+		}
+		httpMuxer = vhost.NewHttpMuxer(httpListener)
+	}
+	var httpsMuxer *vhost.HttpsMuxer
+	if cfg.VhostHttpsPort > 0 {
+		var httpsListener net.Listener
+		httpsListener, err = core.NewListener(ip, cfg.VhostHttpsPort, nil)
+		if err != nil {
+			_ = listener.Close()
+			if httpMuxer != nil {
+				_ = httpMuxer.Close()
+			}
+			return
+		}
+		httpsMuxer = vhost.NewHttpsMuxer(httpsListener)
+	}
+	var natHole *NatHoleServ
+	if cfg.NatHolePort > 0 {
+		natHole, err = NewNatHoleServer(ctx, ip, cfg.NatHolePort)
+		if err != nil {
+			_ = listener.Close()
+			if httpMuxer != nil {
+				_ = httpMuxer.Close()
+			}
+			if httpsMuxer != nil {
+				_ = httpsMuxer.Close()
+			}
+			return
+		}
+	}
 	newCtx := ctx
+	cfgFile, _ := ctx.Value("cfgFile").(string)
 	c = &ControlServ{
-		ip:   ip,
-		port: port,
+		ip:      ip,
+		port:    port,
+		cfg:     cfg,
+		cfgFile: cfgFile,
 
 		controlRecord: NewControlRecord(),
 		clientRecord:  NewClientRecord(),
 
-		Listener: listener,
+		verifier: auth.NewVerifier(cfg.Server.Token),
+
+		allowPorts:        allowPorts,
+		autoPorts:         autoPorts,
+		maxPortsPerClient: cfg.MaxPortsPerClient,
+		maxPoolCount:      cfg.MaxPoolCount,
+
+		maxBandwidthPerClient: maxBandwidthPerClient,
+
+		ipFilter: ipFilter,
+
+		drainTimeout: cfg.DrainTimeout,
+
+		Listener:   listener,
+		httpMuxer:  httpMuxer,
+		httpsMuxer: httpsMuxer,
+		stcpRouter: vhost.NewRouter(listener.Addr()),
+		natHole:    natHole,
 
 		ctx:    newCtx,
 		logger: log.FromContextSafe(newCtx),
 
 		connCh: make(chan net.Conn, 100),
+
+		clients: make(map[string]*clientInfo, 0),
+	}
+	c.metrics = newServerMetrics(c)
+	if cfg.Admin.Addr != "" {
+		c.admin, err = NewAdminServer(c, cfg.Admin.Addr, cfg.Admin.User, cfg.Admin.Password)
+		if err != nil {
+			c.Release()
+			c = nil
+			return
+		}
 	}
 	c.logger.AppendPrefix(c.Addr().String())
 	return
@@ -55,6 +190,31 @@ func NewControlServer(ctx context.Context, ip string, port int) (c *ControlServ,
 func (c *ControlServ) Run() {
 	go c.accept()
 	go c.HandleConn()
+	if c.httpMuxer != nil {
+		go func() {
+			c.logger.Info("vhost http listen %s", c.httpMuxer.Addr().String())
+			err := c.httpMuxer.Serve()
+			c.logger.Warn("vhost http %s", err.Error())
+		}()
+	}
+	if c.httpsMuxer != nil {
+		go func() {
+			c.logger.Info("vhost https listen %s", c.httpsMuxer.Addr().String())
+			err := c.httpsMuxer.Serve()
+			c.logger.Warn("vhost https %s", err.Error())
+		}()
+	}
+	if c.natHole != nil {
+		c.logger.Info("nat hole listen udp %s", c.natHole.LocalAddr().String())
+		go c.natHole.Run()
+	}
+	if c.admin != nil {
+		go func() {
+			c.logger.Info("admin api listen %s", c.admin.Addr().String())
+			err := c.admin.Serve()
+			c.logger.Warn("admin api %s", err.Error())
+		}()
+	}
 }
 
 func (c *ControlServ) accept() {
@@ -69,44 +229,61 @@ func (c *ControlServ) accept() {
 	}
 }
 
-func (c *ControlServ) handleRegister(conner net.Conn, msg *message.Message) {
+// handleRegister verifies a REGISTER and returns the token it was signed
+// with, forward connections also get the salt of their encryption.
+func (c *ControlServ) handleRegister(conner net.Conn, msg *message.Message) (clientID, token, salt string, muxed bool, err error) {
 	var (
+		data     *message.RegisterData
+		resData  string
 		msgBytes []byte
 		msgRes   *message.Message
-		err      error
+		errInt   = 0
+		errInfo  = ""
 	)
 	defer func() {
+		addr := conner.RemoteAddr().String()
 		if err != nil {
-			c.logger.Error(err.Error())
+			c.logger.Error("register %s %s", addr, err.Error())
 		} else {
-			addr := conner.RemoteAddr().String()
 			c.logger.Info("register %s %s", addr, msgRes.String())
 		}
 	}()
-	clientID := tools.GenerateUUID()
-	msgBytes, msgRes, err = core.EncodeOneMsg(clientID, msg.ConnType, msg.Operation, 0, "", "")
+	// a visitor connection opens a new session, a replaced token is refused
+	if msg.ConnType == message.ForwardConn {
+		data, token, err = c.verifier.VerifyForward(msg.Data)
+	} else {
+		data, token, err = c.verifier.Verify(msg.Data)
+	}
+	if err == nil && msg.ConnType == message.ForwardConn {
+		salt, err = core.NewSalt()
+	}
 	if err != nil {
-		return
+		errInt, errInfo = 1, err.Error()
+		c.metrics.registerFailures.With(registerFailureReason(err)).Inc()
+	} else if msg.ConnType != message.ForwardConn && atomic.LoadInt32(&c.shutting) == 1 {
+		// a draining nhole-server only pairs the visitors it has
+		err = fmt.Errorf("nhole-server is shutting down")
+		errInt, errInfo = 2, err.Error()
+	} else {
+		clientID = tools.GenerateUUID()
+		// only control connections can carry multiplexed streams
+		muxed = data.Mux && msg.ConnType == message.ControlConn
+		resData, _ = message.MarshalRegisterResData(muxed, salt)
 	}
-	_, err = conner.Write(msgBytes)
+	msgBytes, msgRes, _ = core.EncodeOneMsg(clientID, msg.ConnType, msg.Operation, errInt, errInfo, resData)
+	_, writeErr := conner.Write(msgBytes)
 	if err != nil {
 		return
 	}
-	if msg.ConnType == message.ControlConn {
-		c.clientRecord.Add(clientID, conner)
-		if conner, ok := conner.(*core.Conn); ok {
-			conner.SetCloseFn(func() (err error) {
-				c.clientRecord.Del(clientID)
-				c.controlRecord.Del(clientID)
-				return
-			})
-		}
-	}
+	err = writeErr
+	return
 }
 
 func (c *ControlServ) createConn(clientID, fserverID, forwardID string) {
 	var (
 		data     string
+		connData *message.CreateConnData
+		fserver  *ForwardServ
 		clienter net.Conn
 		msgBytes []byte
 		err      error
@@ -116,14 +293,31 @@ func (c *ControlServ) createConn(clientID, fserverID, forwardID string) {
 			c.logger.Error(err.Error())
 		}
 	}()
-	data, err = message.MarshalCreateConnData(fserverID, forwardID)
+	fserver, err = c.controlRecord.GetByServerID(fserverID)
 	if err != nil {
 		return
 	}
+	connData = message.NewCreateConnData(fserverID, forwardID)
+	connData.Compression = fserver.compression
+	connData.Encryption = fserver.encryption
 	clienter, err = c.clientRecord.Get(clientID)
 	if err != nil {
 		return
 	}
+	if stream, ok := clienter.(*mux.Stream); ok {
+		c.createMuxConn(stream.Session(), clientID, connData)
+		return
+	}
+	// a dead pooled connection is not acknowledged, try the next one
+	for pooled, ok := c.getPoolConn(clientID); ok; pooled, ok = c.getPoolConn(clientID) {
+		if c.createPoolConn(pooled, clientID, connData) == nil {
+			return
+		}
+	}
+	data, err = message.MarshalCreateConnData(connData)
+	if err != nil {
+		return
+	}
 	msgBytes, _, err = core.EncodeOneMsg(clientID, message.ControlConn, message.CreateForwardConn, 0, "", data)
 	if err != nil {
 		return
@@ -131,7 +325,53 @@ func (c *ControlServ) createConn(clientID, fserverID, forwardID string) {
 	_, err = clienter.Write(msgBytes)
 }
 
-func (c *ControlServ) handleCreateConn(conner net.Conn, msg *message.Message) {
+// createMuxConn opens a stream to the client instead of asking it to dial a
+// new forward connection.
+func (c *ControlServ) createMuxConn(session *mux.Session, clientID string, connData *message.CreateConnData) {
+	var (
+		stream   *mux.Stream
+		data     string
+		token    string
+		msgBytes []byte
+		msg      *message.Message
+		err      error
+	)
+	defer func() {
+		if err != nil {
+			c.logger.Error(err.Error())
+		}
+	}()
+	if connData.Encryption {
+		token, _ = c.getClientToken(clientID)
+		connData.Salt, err = core.NewSalt()
+		if err != nil {
+			return
+		}
+	}
+	data, err = message.MarshalCreateConnData(connData)
+	if err != nil {
+		return
+	}
+	stream, err = session.OpenStream()
+	if err != nil {
+		return
+	}
+	msgBytes, msg, err = core.EncodeOneMsg(clientID, message.ForwardConn, message.CreateForwardConn, 0, "", data)
+	if err != nil {
+		_ = stream.Close()
+		return
+	}
+	_, err = stream.Write(msgBytes)
+	if err != nil {
+		_ = stream.Close()
+		return
+	}
+	c.handleCreateConn(stream, msg, token, connData.Salt)
+}
+
+// handleCreateConn pairs conner with a visitor, token and salt key the
+// encryption of the forward server.
+func (c *ControlServ) handleCreateConn(conner net.Conn, msg *message.Message, token, salt string) {
 	if msg.ConnType != message.ForwardConn {
 		log.Error("handleCreateConn msg.ConnType not is %s", message.ForwardConn)
 		return
@@ -145,6 +385,7 @@ func (c *ControlServ) handleCreateConn(conner net.Conn, msg *message.Message) {
 	defer func() {
 		if err != nil {
 			c.logger.Error(err.Error())
+			_ = conner.Close()
 		} else {
 			addr := conner.RemoteAddr().String()
 			addr2 := fclient.RemoteAddr().String()
@@ -163,13 +404,63 @@ func (c *ControlServ) handleCreateConn(conner net.Conn, msg *message.Message) {
 	if err != nil {
 		return
 	}
-	core.Forward(fclient, conner)
+	// the flag of the echo is not authenticated, never fall back to plaintext
+	if fserver.encryption && !data.Encryption {
+		err = fmt.Errorf("forward connection %s of %s is not encrypted", data.ForwardID, fserver.name)
+		_ = fclient.Close()
+		return
+	}
+	if fserver.encryption {
+		conner, err = core.WrapCryptoConner(conner, token, salt, false)
+		if err != nil {
+			return
+		}
+	}
+	// a nhole-client without compression support does not echo it
+	if fserver.compression && data.Compression {
+		conner = core.WrapCompressConner(conner)
+	}
+	if fserver.protocol == message.UDP {
+		conner = core.WrapDatagramConner(conner)
+	}
+	in, out := c.getLimiters(fserver, data.ForwardID)
+	datagram := fserver.protocol == message.UDP
+	core.ForwardPipe(
+		fclient,
+		conner,
+		core.Pipe{Counter: c.metrics.bytes.With(fserver.name, directionIn), Limiters: in, Datagram: datagram},
+		core.Pipe{Counter: c.metrics.bytes.With(fserver.name, directionOut), Limiters: out, Datagram: datagram},
+	)
+}
+
+// getLimiters returns the limiters of the bytes from visitor forwardID of
+// fserver and of the bytes back to it, the client limiters are those of the
+// member the visitor is assigned to.
+func (c *ControlServ) getLimiters(fserver *ForwardServ, forwardID string) (in, out []core.Limiter) {
+	in, out = make([]core.Limiter, 0, 2), make([]core.Limiter, 0, 2)
+	if fserver.inLimiter != nil {
+		in, out = append(in, fserver.inLimiter), append(out, fserver.outLimiter)
+	}
+	clientID, ok := fserver.assignedClientID(forwardID)
+	if !ok {
+		return
+	}
+	c.RLock()
+	defer c.RUnlock()
+	if client, ok := c.clients[clientID]; ok {
+		in, out = append(in, client.inLimiter), append(out, client.outLimiter)
+	}
+	return
 }
 
-func (c *ControlServ) handleCreateServer(conner net.Conn, msg *message.Message) {
+// handleCreateServer creates the forward server of a service of the control
+// connection clientID, which is bound at REGISTER and never taken from msg.
+func (c *ControlServ) handleCreateServer(conner net.Conn, clientID string, msg *message.Message) {
 	var (
-		port     int
+		data     *message.CreateServerData
+		resData  = msg.Data
 		fserver  *ForwardServ
+		ipFilter *tools.IPFilter
 		msgBytes []byte
 		errInt   = 0
 		err      error
@@ -178,7 +469,7 @@ func (c *ControlServ) handleCreateServer(conner net.Conn, msg *message.Message)
 		if err != nil {
 			c.logger.Error(err.Error())
 		} else {
-			c.logger.Info("create forward server %s:%d %s", c.ip, port, fserver.serverID)
+			c.logger.Info("create forward server %s %s:%d %s", data.Protocol, c.ip, data.ForwardPort, fserver.serverID)
 		}
 	}()
 	defer func() {
@@ -187,35 +478,500 @@ func (c *ControlServ) handleCreateServer(conner net.Conn, msg *message.Message)
 			errInfo = err.Error()
 		}
 		msgBytes, _, _ = core.EncodeOneMsg(
-			msg.ClientID,
+			clientID,
 			message.ControlConn,
 			message.CreateForwardServer,
 			errInt,
 			errInfo,
-			msg.Data,
+			resData,
 		)
 		_, writeErr := conner.Write(msgBytes)
 		if writeErr != nil {
 			err = writeErr
 		}
 	}()
-	port, err = strconv.Atoi(msg.Data)
+	data, err = message.UnmarshalCreateServerData(msg.Data)
+	if err == nil && msg.ClientID != clientID {
+		err = fmt.Errorf("client %s sent the message of %s", clientID, msg.ClientID)
+	}
 	if err != nil {
 		errInt = 1
 		return
 	}
-	err = tools.ValidatePort(port)
+	if atomic.LoadInt32(&c.shutting) == 1 {
+		err = fmt.Errorf("nhole-server is shutting down")
+		errInt = 5
+		return
+	}
+	allowPorts, autoPorts, maxPortsPerClient := c.getLimits()
+	err = tools.ValidatePort(data.ForwardPort)
+	if err == nil {
+		err = message.ValidateProtocol(data.Protocol)
+	}
+	if err == nil && data.BandwidthLimit < 0 {
+		err = fmt.Errorf("bandwidth_limit %d is negative", data.BandwidthLimit)
+	}
+	if err == nil && data.MaxConnections < 0 {
+		err = fmt.Errorf("max_connections %d is negative", data.MaxConnections)
+	}
+	if token, _ := c.getClientToken(clientID); err == nil && data.UseEncryption && token == "" {
+		err = fmt.Errorf("use_encryption requires token on nhole-server")
+	}
+	if err == nil {
+		ipFilter, err = tools.ParseIPFilter(data.AllowIps, data.DenyIps)
+	}
+	if err == nil && (data.Protocol == message.STCP || data.Protocol == message.XTCP) &&
+		(data.Name == "" || data.SecretKey == "") {
+		err = fmt.Errorf("%s service name and secret_key are required", data.Protocol)
+	}
+	if err == nil && data.Group != "" && data.Protocol != message.TCP && data.Protocol != message.UDP {
+		err = fmt.Errorf("group is only supported by tcp and udp services")
+	}
 	if err != nil {
 		errInt = 2
 		return
 	}
-	fserver, err = NewForwardServer(c.ctx, c.ip, port, msg.ClientID, tools.GenerateUUID(), c.createConn)
+	if data.Protocol != message.HTTP && data.Protocol != message.HTTPS &&
+		data.ForwardPort != 0 && !allowPorts.Contains(data.ForwardPort) {
+		err = fmt.Errorf("forward port %d is not in allow_ports of nhole-server", data.ForwardPort)
+		errInt = 4
+		return
+	}
+	// the id is never taken from the client, it could name a server of another
+	data.ServerID = tools.GenerateUUID()
+	if data.Group != "" {
+		c.groupLock.Lock()
+		defer c.groupLock.Unlock()
+		if group, ok := c.controlRecord.getGroupServer(data.Group); ok {
+			errInt, err = c.joinGroup(group, clientID, data, maxPortsPerClient)
+			if err != nil {
+				return
+			}
+			fserver = group
+			data.ForwardPort = group.Port()
+			data.SecretKey, data.GroupKey = "", ""
+			resData, _ = message.MarshalCreateServerData(data)
+			return
+		}
+	}
+	switch data.Protocol {
+	case message.HTTP:
+		if c.httpMuxer == nil {
+			err = fmt.Errorf("vhost_http_port is not enabled on nhole-server")
+			break
+		}
+		fserver, err = c.newVhostForwardServer(c.httpMuxer.Router, clientID, data)
+	case message.HTTPS:
+		if c.httpsMuxer == nil {
+			err = fmt.Errorf("vhost_https_port is not enabled on nhole-server")
+			break
+		}
+		fserver, err = c.newVhostForwardServer(c.httpsMuxer.Router, clientID, data)
+	case message.STCP, message.XTCP:
+		fserver, err = c.newStcpForwardServer(clientID, data)
+	default:
+		if data.ForwardPort == 0 {
+			fserver, err = c.newAutoForwardServer(clientID, data, allowPorts, autoPorts)
+			break
+		}
+		fserver, err = NewForwardServer(c.ctx, c.ip, data.ForwardPort, data.Protocol, clientID, data.ServerID, c.createConn)
+	}
 	if err != nil {
 		errInt = 3
-	} else {
-		c.controlRecord.Add(msg.ClientID, msg.Data, fserver)
-		fserver.Run()
+		return
+	}
+	fserver.name = data.Name
+	fserver.customDomains = data.CustomDomains
+	if data.BandwidthLimit > 0 {
+		fserver.inLimiter = tools.NewRateLimiter(data.BandwidthLimit)
+		fserver.outLimiter = tools.NewRateLimiter(data.BandwidthLimit)
 	}
+	fserver.compression = data.UseCompression
+	fserver.encryption = data.UseEncryption
+	fserver.maxConnections = data.MaxConnections
+	fserver.rejectCounter = c.metrics.rejectedConns.With(data.Name)
+	fserver.ipFilter = ipFilter
+	fserver.serverFilter = c.getIPFilter
+	fserver.denyCounter = c.metrics.deniedConns.With(data.Name)
+	fserver.group = data.Group
+	fserver.groupKey = data.GroupKey
+	fserver.loadBalance = data.LoadBalance
+	err = c.controlRecord.Add(clientID, data.ServerID, fserver, maxPortsPerClient)
+	if err != nil {
+		_ = fserver.Close()
+		errInt = 4
+		return
+	}
+	fserver.Run()
+	// the secret key is not sent back
+	data.SecretKey, data.GroupKey = "", ""
+	resData, _ = message.MarshalCreateServerData(data)
+}
+
+// joinGroup adds the service of data to the forward server of its group, the
+// service has to agree with the group on group_key and the forwarding options.
+func (c *ControlServ) joinGroup(
+	fserver *ForwardServ,
+	clientID string,
+	data *message.CreateServerData,
+	maxPortsPerClient int,
+) (errInt int, err error) {
+	switch {
+	case !hmac.Equal([]byte(fserver.groupKey), []byte(data.GroupKey)):
+		err = fmt.Errorf("group_key of group %s mismatch", data.Group)
+	case fserver.protocol != data.Protocol:
+		err = fmt.Errorf("group %s is %s, not %s", data.Group, fserver.protocol, data.Protocol)
+	case data.ForwardPort != 0 && data.ForwardPort != fserver.Port():
+		err = fmt.Errorf("group %s is on forward port %d, not %d", data.Group, fserver.Port(), data.ForwardPort)
+	case fserver.loadBalance != data.LoadBalance:
+		err = fmt.Errorf("group %s balances by %s, not %s", data.Group, fserver.loadBalance, data.LoadBalance)
+	case fserver.encryption != data.UseEncryption || fserver.compression != data.UseCompression:
+		err = fmt.Errorf("use_encryption and use_compression of group %s mismatch", data.Group)
+	}
+	if err != nil {
+		errInt = 2
+		return
+	}
+	if !fserver.addMember(clientID, data.ServerID) {
+		err = fmt.Errorf("group %s is closing", data.Group)
+		errInt = 3
+		return
+	}
+	err = c.controlRecord.Add(clientID, data.ServerID, fserver, maxPortsPerClient)
+	if err != nil {
+		fserver.removeMember(data.ServerID)
+		errInt = 4
+	}
+	return
+}
+
+// newStcpForwardServer serves the visitors of a stcp or xtcp service, they
+// come through the control port instead of a port of their own.
+func (c *ControlServ) newStcpForwardServer(clientID string, data *message.CreateServerData) (fserver *ForwardServ, err error) {
+	var listener *vhost.Listener
+	listener, err = c.stcpRouter.Listen([]string{data.Name})
+	if err != nil {
+		err = fmt.Errorf("stcp service %s is already registered", data.Name)
+		return
+	}
+	data.ForwardPort = 0
+	fserver = NewForwardServerByListener(c.ctx, listener, c.ip, 0, data.Protocol, clientID, data.ServerID, c.createConn)
+	fserver.secret = auth.NewVerifier(data.SecretKey)
+	return
+}
+
+func (c *ControlServ) getStcpServer(name string) (fserver *ForwardServ, err error) {
+	listener, ok := c.stcpRouter.Get(name)
+	if ok {
+		for _, server := range c.controlRecord.getAll() {
+			if server.Listener == net.Listener(listener) {
+				fserver = server
+				return
+			}
+		}
+	}
+	err = fmt.Errorf("stcp service %s not found", name)
+	return
+}
+
+// verifyVisitor finds the service of a visitor and checks its secret.
+func (c *ControlServ) verifyVisitor(data *message.VisitorConnData) (fserver *ForwardServ, errInt int, err error) {
+	fserver, err = c.getStcpServer(data.Name)
+	if err != nil {
+		errInt = 2
+		return
+	}
+	_, _, err = fserver.secret.Verify(data.Auth)
+	if err != nil {
+		err = fmt.Errorf("stcp service %s secret_key %s", data.Name, err.Error())
+		errInt = 3
+	}
+	return
+}
+
+// handleVisitorConn checks the secret of a stcp service and hands conner to
+// its forward server, which pairs it with nhole-client like any visitor.
+func (c *ControlServ) handleVisitorConn(conner net.Conn, msg *message.Message) {
+	var (
+		data     *message.VisitorConnData
+		fserver  *ForwardServ
+		msgBytes []byte
+		errInt   = 0
+		errInfo  = ""
+		err      error
+	)
+	defer func() {
+		if err != nil {
+			c.logger.Error("visitor %s %s", conner.RemoteAddr().String(), err.Error())
+			_ = conner.Close()
+		} else {
+			c.logger.Info("visitor %s of stcp service %s", conner.RemoteAddr().String(), data.Name)
+		}
+	}()
+	data, err = message.UnmarshalVisitorConnData(msg.Data)
+	if err != nil {
+		errInt = 1
+	}
+	if err == nil {
+		fserver, errInt, err = c.verifyVisitor(data)
+	}
+	if err != nil {
+		errInfo = err.Error()
+	}
+	msgBytes, _, _ = core.EncodeOneMsg(msg.ClientID, message.VisitorConn, message.CreateVisitorConn, errInt, errInfo, "")
+	_, writeErr := conner.Write(msgBytes)
+	if err != nil {
+		return
+	}
+	err = writeErr
+	if err != nil {
+		return
+	}
+	err = fserver.Listener.(*vhost.Listener).Put(conner)
+}
+
+// handleNatHole asks the nhole-client of a xtcp service to punch to the
+// visitor on conner, which falls back to CREATE_VISITOR_CONN if it fails.
+func (c *ControlServ) handleNatHole(conner net.Conn, msg *message.Message) {
+	var (
+		data     *message.VisitorConnData
+		fserver  *ForwardServ
+		resData  string
+		msgBytes []byte
+		errInt   = 0
+		errInfo  = ""
+		err      error
+	)
+	defer func() {
+		if err != nil {
+			c.logger.Warn("nat hole of visitor %s %s", conner.RemoteAddr().String(), err.Error())
+			errInfo = err.Error()
+		} else {
+			c.logger.Info("nat hole of visitor %s to xtcp service %s", conner.RemoteAddr().String(), data.Name)
+		}
+		msgBytes, _, _ = core.EncodeOneMsg(msg.ClientID, message.VisitorConn, message.NatHole, errInt, errInfo, resData)
+		_, _ = conner.Write(msgBytes)
+	}()
+	data, err = message.UnmarshalVisitorConnData(msg.Data)
+	if err != nil {
+		errInt = 1
+		return
+	}
+	fserver, errInt, err = c.verifyVisitor(data)
+	if err != nil {
+		return
+	}
+	if fserver.protocol != message.XTCP || len(data.Sid) != core.SaltLen {
+		err = fmt.Errorf("%s is not a xtcp service or sid %s is bad", data.Name, data.Sid)
+		errInt = 4
+		return
+	}
+	if c.natHole == nil {
+		err = fmt.Errorf("nat_hole_port is not enabled on nhole-server")
+		errInt = 5
+		return
+	}
+	c.natHole.Add(data.Sid)
+	natHoleData := &message.NatHoleData{
+		ServerID: fserver.serverID,
+		Sid:      data.Sid,
+		Port:     c.natHole.LocalAddr().(*net.UDPAddr).Port,
+	}
+	err = c.sendNatHole(fserver.clientID, natHoleData)
+	if err != nil {
+		errInt = 6
+		return
+	}
+	natHoleData.ServerID = ""
+	resData, err = message.MarshalNatHoleData(natHoleData)
+}
+
+// sendNatHole tells nhole-client to punch to a visitor.
+func (c *ControlServ) sendNatHole(clientID string, natHoleData *message.NatHoleData) (err error) {
+	var (
+		data     string
+		clienter net.Conn
+		msgBytes []byte
+	)
+	clienter, err = c.clientRecord.Get(clientID)
+	if err != nil {
+		return
+	}
+	data, err = message.MarshalNatHoleData(natHoleData)
+	if err != nil {
+		return
+	}
+	msgBytes, _, err = core.EncodeOneMsg(clientID, message.ControlConn, message.NatHole, 0, "", data)
+	if err != nil {
+		return
+	}
+	_, err = clienter.Write(msgBytes)
+	return
+}
+
+// newVhostForwardServer serves the custom domains of data from a shared vhost port.
+func (c *ControlServ) newVhostForwardServer(router *vhost.Router, clientID string, data *message.CreateServerData) (fserver *ForwardServ, err error) {
+	var listener *vhost.Listener
+	listener, err = router.Listen(data.CustomDomains)
+	if err != nil {
+		return
+	}
+	data.ForwardPort = router.Addr().(*net.TCPAddr).Port
+	fserver = NewForwardServerByListener(c.ctx, listener, c.ip, data.ForwardPort, data.Protocol, clientID, data.ServerID, c.createConn)
+	return
+}
+
+// newAutoForwardServer listens on a free port of auto_ports, or on any port
+// the system picks when no pool is configured, and records it in data.
+func (c *ControlServ) newAutoForwardServer(
+	clientID string,
+	data *message.CreateServerData,
+	allowPorts, autoPorts tools.PortRanges,
+) (fserver *ForwardServ, err error) {
+	if len(autoPorts) == 0 {
+		fserver, err = NewForwardServer(c.ctx, c.ip, 0, data.Protocol, clientID, data.ServerID, c.createConn)
+		if err != nil {
+			return
+		}
+		data.ForwardPort = fserver.Port()
+		return
+	}
+	ports := autoPorts.Ports()
+	for _, i := range rand.Perm(len(ports)) {
+		if !allowPorts.Contains(ports[i]) {
+			continue
+		}
+		fserver, err = NewForwardServer(c.ctx, c.ip, ports[i], data.Protocol, clientID, data.ServerID, c.createConn)
+		if err == nil {
+			data.ForwardPort = ports[i]
+			return
+		}
+	}
+	err = fmt.Errorf("no free port in auto_ports of nhole-server")
+	return
+}
+
+// handleCloseServer closes one forward server of clientID, keeps the others
+// and acknowledges with the result.
+func (c *ControlServ) handleCloseServer(conner net.Conn, clientID string, msg *message.Message) {
+	var (
+		data     *message.CloseServerData
+		msgBytes []byte
+		errInt   = 0
+		err      error
+	)
+	defer func() {
+		if err != nil {
+			c.logger.Error(err.Error())
+		} else {
+			c.logger.Info("close forward server %s %s", data.Name, data.ServerID)
+		}
+	}()
+	defer func() {
+		errInfo := ""
+		if err != nil {
+			errInfo = err.Error()
+		}
+		msgBytes, _, _ = core.EncodeOneMsg(
+			clientID,
+			message.ControlConn,
+			message.CloseForwardServer,
+			errInt,
+			errInfo,
+			msg.Data,
+		)
+		_, writeErr := conner.Write(msgBytes)
+		if writeErr != nil {
+			err = writeErr
+		}
+	}()
+	data, err = message.UnmarshalCloseServerData(msg.Data)
+	if err != nil {
+		errInt = 1
+		return
+	}
+	err = c.controlRecord.DelServer(clientID, data.ServerID)
+	if err != nil {
+		errInt = 2
+	}
+}
+
+func (c *ControlServ) getIPFilter() (ipFilter *tools.IPFilter) {
+	c.RLock()
+	defer c.RUnlock()
+	ipFilter = c.ipFilter
+	return
+}
+
+func (c *ControlServ) getLimits() (allowPorts, autoPorts tools.PortRanges, maxPortsPerClient int) {
+	c.RLock()
+	defer c.RUnlock()
+	allowPorts, autoPorts, maxPortsPerClient = c.allowPorts, c.autoPorts, c.maxPortsPerClient
+	return
+}
+
+// Reload re-reads the config file and applies the token, port, pool and bandwidth
+// limits, ip filter and drain timeout, connected clients are kept.
+func (c *ControlServ) Reload() (err error) {
+	var (
+		cfg                   *config.ServerCfg
+		allowPorts, autoPorts tools.PortRanges
+		maxBandwidthPerClient int64
+		ipFilter              *tools.IPFilter
+	)
+	cfg, err = config.UnmarshalServerCfgByFile(c.cfgFile)
+	if err != nil {
+		return
+	}
+	allowPorts, err = tools.ParsePortRanges(cfg.AllowPorts)
+	if err != nil {
+		return
+	}
+	autoPorts, err = tools.ParsePortRanges(cfg.AutoPorts)
+	if err != nil {
+		return
+	}
+	if len(autoPorts) == 0 {
+		autoPorts = allowPorts
+	}
+	maxBandwidthPerClient, err = tools.ParseBandwidth(cfg.MaxBandwidthPerClient)
+	if err != nil {
+		return
+	}
+	ipFilter, err = tools.ParseIPFilter(cfg.AllowIps, cfg.DenyIps)
+	if err != nil {
+		return
+	}
+	c.RLock()
+	running := c.cfg
+	c.RUnlock()
+	if cfg.Server.Ip != running.Server.Ip || cfg.Server.ControlPort != running.Server.ControlPort ||
+		cfg.VhostHttpPort != running.VhostHttpPort || cfg.VhostHttpsPort != running.VhostHttpsPort ||
+		cfg.NatHolePort != running.NatHolePort || cfg.Admin != running.Admin ||
+		cfg.Server.TLS.Enable != running.Server.TLS.Enable {
+		c.logger.Warn("restart nhole-server to apply listen address, vhost, nat hole, admin and tls changes")
+	}
+	// c.cfg is the running config, what needs a restart keeps its running value
+	cfg.Server.Ip, cfg.Server.ControlPort = running.Server.Ip, running.Server.ControlPort
+	cfg.VhostHttpPort, cfg.VhostHttpsPort = running.VhostHttpPort, running.VhostHttpsPort
+	cfg.NatHolePort, cfg.Admin = running.NatHolePort, running.Admin
+	cfg.Server.TLS = running.Server.TLS
+	c.verifier.SetToken(cfg.Server.Token)
+	c.Lock()
+	defer c.Unlock()
+	c.cfg = cfg
+	c.allowPorts = allowPorts
+	c.autoPorts = autoPorts
+	c.maxPortsPerClient = cfg.MaxPortsPerClient
+	c.maxPoolCount = cfg.MaxPoolCount
+	c.maxBandwidthPerClient = maxBandwidthPerClient
+	c.ipFilter = ipFilter
+	for _, client := range c.clients {
+		client.inLimiter.SetRate(maxBandwidthPerClient)
+		client.outLimiter.SetRate(maxBandwidthPerClient)
+	}
+	c.drainTimeout = cfg.DrainTimeout
+	return
 }
 
 func (c *ControlServ) handleHeartbeat(conner net.Conn, msg *message.Message) {
@@ -240,34 +996,74 @@ func (c *ControlServ) handleHeartbeat(conner net.Conn, msg *message.Message) {
 
 func (c *ControlServ) handleConn(conn net.Conn) {
 	c.logger.Info("Connection from %s", conn.RemoteAddr().String())
+	var (
+		clientID string
+		token    string
+		salt     string
+		muxed    bool
+		control  net.Conn
+	)
 	conner := core.WrapConner(conn, 60*time.Second, nil)
 	for {
 		msg, err := core.DecodeOneMsg(conner)
 		if err != nil {
+			c.logger.Warn("%s %s", conn.RemoteAddr().String(), err.Error())
+			_ = conner.Close()
 			return
 		}
-		if msg.Operation != message.REGISTER ||
-			(msg.ConnType != message.ControlConn && msg.ConnType != message.ForwardConn) {
+		if msg.Operation != message.REGISTER || message.ValidateConnType(msg.ConnType) != nil {
 			continue
 		}
-		go c.handleRegister(conner, msg)
+		clientID, token, salt, muxed, err = c.handleRegister(conner, msg)
+		if err != nil {
+			_ = conner.Close()
+			return
+		}
 		switch msg.ConnType {
 		case message.ControlConn:
 			goto controlConn
 		case message.ForwardConn:
 			goto forwardConn
+		case message.VisitorConn:
+			goto visitorConn
 		}
 	}
 forwardConn:
 	for {
 		msg, err := core.DecodeOneMsg(conner)
 		if err != nil {
+			_ = conner.Close()
 			return
 		}
 		if msg.Operation == message.CreateForwardConn && msg.ConnType == message.ForwardConn {
 			_ = conner.SetReadTimeout(0)
-			go c.handleCreateConn(conner, msg)
+			go c.handleCreateConn(conner, msg, token, salt)
+			return
+		}
+		if msg.Operation == message.PoolForwardConn && msg.ConnType == message.ForwardConn {
+			_ = conner.SetReadTimeout(0)
+			c.handlePoolConn(conner, msg, token, salt)
+			return
+		}
+	}
+visitorConn:
+	for {
+		msg, err := core.DecodeOneMsg(conner)
+		if err != nil {
+			_ = conner.Close()
+			return
+		}
+		if msg.ConnType != message.VisitorConn {
+			continue
+		}
+		switch msg.Operation {
+		case message.CreateVisitorConn:
+			_ = conner.SetReadTimeout(0)
+			go c.handleVisitorConn(conner, msg)
 			return
+		case message.NatHole:
+			// the visitor sends CREATE_VISITOR_CONN if punching fails
+			c.handleNatHole(conner, msg)
 		}
 	}
 controlConn:
@@ -279,24 +1075,44 @@ controlConn:
 			c.logger.Info("%s Close.", conner.RemoteAddr().String())
 		}
 	}()
-	msgCh := core.Decode2MsgCh(conner)
+	control = conner
+	if muxed {
+		stream, err := mux.Server(conner).AcceptStream()
+		if err != nil {
+			return
+		}
+		control = stream
+	}
+	c.clientRecord.Add(clientID, control)
+	c.addClient(clientID, conn, muxed, token)
+	conner.SetCloseFn(func() (err error) {
+		c.clientRecord.Del(clientID)
+		c.controlRecord.Del(clientID)
+		c.delClient(clientID)
+		return
+	})
+	msgCh := core.Decode2MsgCh(control)
 	for msg := range msgCh {
 		if msg.Operation != message.HEARTBEAT {
 			c.logger.Info("message from %s %s", conn.RemoteAddr().String(), msg.String())
 		}
 		switch msg.Operation {
-		case message.REGISTER:
-			// register
-			go c.handleRegister(conner, msg)
 		case message.CreateForwardConn:
 			// create forward conn
-			go c.handleCreateConn(conner, msg)
+			go c.handleCreateConn(control, msg, "", "")
 		case message.CreateForwardServer:
 			// create forward server
-			go c.handleCreateServer(conner, msg)
+			go c.handleCreateServer(control, clientID, msg)
 		case message.HEARTBEAT:
 			// heartbeat
-			go c.handleHeartbeat(conner, msg)
+			c.touchClient(clientID)
+			go c.handleHeartbeat(control, msg)
+		case message.CloseForwardServer:
+			// close forward server
+			go c.handleCloseServer(control, clientID, msg)
+		case message.SHUTDOWN:
+			// the client is draining, send it no more visitors
+			c.controlRecord.StopAccept(clientID)
 		default:
 			// error
 			c.logger.Warn("error message from %s %s", conn.RemoteAddr().String(), msg.String())
@@ -310,10 +1126,69 @@ func (c *ControlServ) HandleConn() {
 	}
 }
 
+// Shutdown stops accepting clients and visitors, tells the clients and waits
+// up to drain_timeout for the forwarded connections before releasing them.
+// The control port is closed last, the visitors waiting for a forward
+// connection are still paired.
+func (c *ControlServ) Shutdown() (err error) {
+	if !atomic.CompareAndSwapInt32(&c.shutting, 0, 1) {
+		return
+	}
+	defer c.Release()
+	c.RLock()
+	drainTimeout := c.drainTimeout
+	c.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if c.httpMuxer != nil {
+		go func() {
+			_ = c.httpMuxer.Shutdown(ctx)
+		}()
+	}
+	if c.httpsMuxer != nil {
+		_ = c.httpsMuxer.Close()
+	}
+	c.controlRecord.StopAcceptAll()
+	for clientID, clienter := range c.clientRecord.GetAllByID() {
+		msgBytes, _, _ := core.EncodeOneMsg(clientID, message.ControlConn, message.SHUTDOWN, 0, "", "")
+		_, _ = clienter.Write(msgBytes)
+	}
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		active := c.controlRecord.Active()
+		if active == 0 {
+			c.logger.Info("all forwarded connections drained")
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			err = fmt.Errorf("drain timeout %s, force close %d forwarded connections", drainTimeout, active)
+			return
+		}
+	}
+}
+
 func (c *ControlServ) Release() {
+	atomic.StoreInt32(&c.shutting, 1)
 	err := c.Close()
-	if err != nil {
+	if err != nil && !errors.Is(err, net.ErrClosed) {
 		c.logger.Warn(err.Error())
 	}
+	if c.httpMuxer != nil {
+		_ = c.httpMuxer.Close()
+	}
+	if c.httpsMuxer != nil {
+		_ = c.httpsMuxer.Close()
+	}
+	if c.natHole != nil {
+		_ = c.natHole.Close()
+	}
+	if c.admin != nil {
+		_ = c.admin.Close()
+	}
+	c.controlRecord.Clear()
+	c.clientRecord.Clear()
 	return
 }
@@ -0,0 +1,119 @@
+package control
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/biandc/nhole/pkg/auth"
+	"github.com/biandc/nhole/pkg/config"
+	"github.com/biandc/nhole/pkg/core"
+	"github.com/biandc/nhole/pkg/log"
+	"github.com/biandc/nhole/pkg/message"
+)
+
+func TestControlServCreateServerForeignClientID(t *testing.T) {
+	c := &ControlServ{
+		controlRecord: NewControlRecord(),
+		clientRecord:  NewClientRecord(),
+		clients:       make(map[string]*clientInfo, 0),
+		logger:        log.New(),
+	}
+	control, peer := net.Pipe()
+	defer control.Close()
+	defer peer.Close()
+	data, err := message.MarshalCreateServerData(message.NewCreateServerData(0, message.TCP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := core.EncodeOneMsg("c2", message.ControlConn, message.CreateForwardServer, 0, "", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.handleCreateServer(control, "c1", msg)
+	res, err := core.DecodeOneMsg(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Error == 0 || res.ClientID != "c1" {
+		t.Fatalf("forward server of c2 created by c1 %s", res.String())
+	}
+	if servers := c.controlRecord.GetByClientID("c2"); len(servers) != 0 {
+		t.Fatalf("%d forward servers recorded for c2", len(servers))
+	}
+}
+
+func TestControlServReload(t *testing.T) {
+	cfgFile := filepath.Join(t.TempDir(), "nhole-server.yaml")
+	write := func(content string) {
+		if err := os.WriteFile(cfgFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("server:\n  ip: 127.0.0.1\n  control_port: 7000\n  token: a\nmax_ports_per_client: 1\n")
+	cfg, err := config.UnmarshalServerCfgByFile(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &ControlServ{
+		cfg:      cfg,
+		cfgFile:  cfgFile,
+		verifier: auth.NewVerifier(cfg.Server.Token),
+		clients:  make(map[string]*clientInfo, 0),
+		logger:   log.New(),
+	}
+	write("server:\n  ip: 127.0.0.1\n  control_port: 7001\n  token: b\nmax_ports_per_client: 2\n")
+	if err = c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if c.cfg.MaxPortsPerClient != 2 || c.cfg.Server.Token != "b" || c.maxPortsPerClient != 2 {
+		t.Fatalf("reloaded config not applied %+v", c.cfg)
+	}
+	// the control port needs a restart, the running one is kept
+	if c.cfg.Server.ControlPort != 7000 {
+		t.Fatalf("running control port %d", c.cfg.Server.ControlPort)
+	}
+	write("server:\n  ip: 127.0.0.1\n  control_port: 7001\n  token: b\nmax_ports_per_client: 3\n")
+	if err = c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if c.cfg.MaxPortsPerClient != 3 || c.cfg.Server.ControlPort != 7000 {
+		t.Fatalf("second reload %+v", c.cfg)
+	}
+}
+
+func TestControlServRegisterShutting(t *testing.T) {
+	c := &ControlServ{
+		verifier: auth.NewVerifier("abc"),
+		clients:  make(map[string]*clientInfo, 0),
+		logger:   log.New(),
+		shutting: 1,
+	}
+	c.metrics = newServerMetrics(c)
+	for connType, ok := range map[string]bool{
+		message.ControlConn: false,
+		message.VisitorConn: false,
+		// the forward connections of draining clients are still paired
+		message.ForwardConn: true,
+	} {
+		data, err := auth.NewRegisterData("abc", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, msg, err := core.EncodeOneMsg("", connType, message.REGISTER, 0, "", data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, peer := net.Pipe()
+		go func() {
+			_, _ = core.DecodeOneMsg(peer)
+		}()
+		_, _, _, _, err = c.handleRegister(conn, msg)
+		if (err == nil) != ok {
+			t.Fatalf("%s registered while shutting down %v", connType, err)
+		}
+		_ = conn.Close()
+		_ = peer.Close()
+	}
+}
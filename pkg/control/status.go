@@ -0,0 +1,157 @@
+package control
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+type ServiceState string
+
+const (
+	ServicePending ServiceState = "pending"
+	ServiceActive  ServiceState = "active"
+	ServiceFailed  ServiceState = "failed"
+	// ServiceUnhealthy services failed their health check, their forward
+	// servers are closed until they are healthy again
+	ServiceUnhealthy ServiceState = "unhealthy"
+)
+
+// serviceState is what nhole-client knows about one of its services.
+type serviceState struct {
+	state       ServiceState
+	errorInfo   string
+	connections int
+}
+
+type ServiceStatus struct {
+	Name          string       `json:"name"`
+	Protocol      string       `json:"protocol"`
+	LocalAddr     string       `json:"local_addr"`
+	ForwardPort   int          `json:"forward_port"`
+	CustomDomains []string     `json:"custom_domains,omitempty"`
+	State         ServiceState `json:"state"`
+	ErrorInfo     string       `json:"error_info,omitempty"`
+	Connections   int          `json:"connections"`
+}
+
+type LocalStatus struct {
+	State     ClientState      `json:"state"`
+	ClientID  string           `json:"client_id"`
+	Server    string           `json:"server"`
+	ErrorInfo string           `json:"error_info,omitempty"`
+	Services  []*ServiceStatus `json:"services"`
+}
+
+// Status reports the connection and the state of every service.
+func (c *ControlClient) Status() (status *LocalStatus) {
+	c.RLock()
+	defer c.RUnlock()
+	status = &LocalStatus{
+		State:     c.state,
+		ClientID:  c.clientID,
+		Server:    net.JoinHostPort(c.ip, fmt.Sprint(c.port)),
+		ErrorInfo: c.errorInfo,
+		Services:  make([]*ServiceStatus, 0, len(c.services)),
+	}
+	for name, service := range c.services {
+		serviceStatus := &ServiceStatus{
+			Name:          name,
+			Protocol:      service.protocol,
+			LocalAddr:     net.JoinHostPort(service.ip, fmt.Sprint(service.port)),
+			ForwardPort:   service.forwardPort,
+			CustomDomains: service.customDomains,
+			State:         ServicePending,
+		}
+		if forwardPort, ok := c.forwardPorts[name]; ok {
+			serviceStatus.ForwardPort = forwardPort
+		}
+		if state, ok := c.serviceStates[name]; ok {
+			serviceStatus.State = state.state
+			serviceStatus.ErrorInfo = state.errorInfo
+			serviceStatus.Connections = state.connections
+		}
+		status.Services = append(status.Services, serviceStatus)
+	}
+	sort.Slice(status.Services, func(i, j int) bool {
+		return status.Services[i].Name < status.Services[j].Name
+	})
+	return
+}
+
+func (c *ControlClient) setServiceState(name string, state ServiceState, errorInfo string) {
+	c.Lock()
+	defer c.Unlock()
+	s, ok := c.serviceStates[name]
+	if !ok {
+		s = &serviceState{}
+		c.serviceStates[name] = s
+	}
+	s.state = state
+	s.errorInfo = errorInfo
+}
+
+func (c *ControlClient) addServiceConn(name string, delta int) {
+	c.Lock()
+	defer c.Unlock()
+	if s, ok := c.serviceStates[name]; ok {
+		s.connections += delta
+	}
+}
+
+// StatusServ serves the status of nhole-client on GET /api/status and its
+// metrics on /metrics, it is meant to listen on loopback only.
+type StatusServ struct {
+	client *ControlClient
+
+	listener net.Listener
+	server   *http.Server
+}
+
+func NewStatusServer(client *ControlClient, addr string) (s *StatusServ, err error) {
+	var listener net.Listener
+	listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+	s = &StatusServ{
+		client:   client,
+		listener: listener,
+	}
+	s.server = &http.Server{
+		Handler:           s.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return
+}
+
+func (s *StatusServ) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/status", s.handleStatus)
+	mux.Handle("/metrics", s.client.metrics.registry)
+	return mux
+}
+
+func (s *StatusServ) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+func (s *StatusServ) Serve() (err error) {
+	err = s.server.Serve(s.listener)
+	return
+}
+
+func (s *StatusServ) Close() (err error) {
+	err = s.server.Close()
+	return
+}
+
+func (s *StatusServ) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.client.Status())
+}
@@ -0,0 +1,81 @@
+package control
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestStatusClient() (c *ControlClient) {
+	c = &ControlClient{
+		ip:       "127.0.0.1",
+		port:     7000,
+		state:    StateRegistered,
+		clientID: "c1",
+		services: map[string]ServiceInfo{
+			"web": {name: "web", ip: "127.0.0.1", port: 80, protocol: "http", customDomains: []string{"www.example.com"}},
+			"ssh": {name: "ssh", ip: "127.0.0.1", port: 22, protocol: "tcp"},
+			"dns": {name: "dns", ip: "127.0.0.1", port: 53, protocol: "udp", forwardPort: 5353},
+		},
+		forwardPorts:  map[string]int{"ssh": 6022},
+		serviceStates: make(map[string]*serviceState, 0),
+		clientRecord:  NewClientRecord(),
+	}
+	c.metrics = newClientMetrics(c)
+	return
+}
+
+func TestControlClientStatus(t *testing.T) {
+	c := newTestStatusClient()
+	c.setServiceState("ssh", ServiceActive, "")
+	c.addServiceConn("ssh", 2)
+	c.addServiceConn("ssh", -1)
+	c.setServiceState("dns", ServiceFailed, "port in use")
+	c.addServiceConn("web", 1)
+
+	status := c.Status()
+	if status.State != StateRegistered || status.ClientID != "c1" || status.Server != "127.0.0.1:7000" {
+		t.Fatalf("status %+v", status)
+	}
+	want := []ServiceStatus{
+		{Name: "dns", ForwardPort: 5353, State: ServiceFailed, ErrorInfo: "port in use"},
+		{Name: "ssh", ForwardPort: 6022, State: ServiceActive, Connections: 1},
+		{Name: "web", State: ServicePending},
+	}
+	if len(status.Services) != len(want) {
+		t.Fatalf("%d services, want %d", len(status.Services), len(want))
+	}
+	for i, got := range status.Services {
+		if got.Name != want[i].Name || got.ForwardPort != want[i].ForwardPort || got.State != want[i].State ||
+			got.ErrorInfo != want[i].ErrorInfo || got.Connections != want[i].Connections {
+			t.Fatalf("service %d %+v, want %+v", i, got, want[i])
+		}
+	}
+	if status.Services[2].LocalAddr != "127.0.0.1:80" || len(status.Services[2].CustomDomains) != 1 {
+		t.Fatalf("web %+v", status.Services[2])
+	}
+}
+
+func TestStatusServ(t *testing.T) {
+	s := &StatusServ{client: newTestStatusClient()}
+	w := httptest.NewRecorder()
+	s.handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/status", nil))
+	var status LocalStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("GET /api/status = %d %v", w.Code, err)
+	}
+	if status.ClientID != "c1" || len(status.Services) != 3 {
+		t.Fatalf("status %+v", status)
+	}
+	w = httptest.NewRecorder()
+	s.handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/status", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST /api/status = %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /metrics = %d", w.Code)
+	}
+}
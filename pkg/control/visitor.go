@@ -0,0 +1,273 @@
+package control
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/biandc/nhole/pkg/auth"
+	"github.com/biandc/nhole/pkg/config"
+	"github.com/biandc/nhole/pkg/core"
+	"github.com/biandc/nhole/pkg/log"
+	"github.com/biandc/nhole/pkg/message"
+)
+
+// Visitor forwards the connections of a local listener to a stcp service of
+// another nhole-client, each one over a new connection to nhole-server. A xtcp
+// visitor first tries a direct udp connection to the nhole-client.
+type Visitor struct {
+	name       string
+	protocol   string
+	serverName string
+	secretKey  string
+
+	ip        string
+	port      int
+	token     string
+	tlsConfig *tls.Config
+
+	net.Listener
+
+	ctx    context.Context
+	logger *log.Logger
+
+	conns map[net.Conn]struct{}
+	sync.Mutex
+}
+
+func NewVisitor(
+	ctx context.Context,
+	cfg *config.Visitor,
+	ip string,
+	port int,
+	token string,
+	tlsConfig *tls.Config,
+) (v *Visitor, err error) {
+	var listener net.Listener
+	listener, err = core.NewListener(cfg.BindIp, cfg.BindPort, nil)
+	if err != nil {
+		return
+	}
+	v = &Visitor{
+		name:       cfg.Name,
+		protocol:   cfg.Protocol,
+		serverName: cfg.ServerName,
+		secretKey:  cfg.SecretKey,
+
+		ip:        ip,
+		port:      port,
+		token:     token,
+		tlsConfig: tlsConfig,
+
+		Listener: listener,
+
+		ctx:    ctx,
+		logger: log.FromContextSafe(ctx),
+
+		conns: make(map[net.Conn]struct{}, 0),
+	}
+	v.logger.AppendPrefix(v.name)
+	return
+}
+
+func (v *Visitor) Run() {
+	for {
+		conn, err := v.Accept()
+		if err != nil {
+			v.logger.Warn(err.Error())
+			return
+		}
+		go v.handleConn(conn)
+	}
+}
+
+func (v *Visitor) handleConn(localConn net.Conn) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	defer func() {
+		if err != nil {
+			v.logger.Error("visit %s service %s %s", v.protocol, v.serverName, err.Error())
+			_ = localConn.Close()
+			if conn != nil {
+				_ = conn.Close()
+			}
+		} else {
+			v.logger.Info("visiting %s service %s from %s", v.protocol, v.serverName, localConn.RemoteAddr().String())
+		}
+	}()
+	conn, err = core.NewConner(v.ip, v.port, v.tlsConfig)
+	if err != nil {
+		return
+	}
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	err = v.register(conn)
+	if err != nil {
+		return
+	}
+	direct := false
+	if v.protocol == message.XTCP {
+		var natHoleConn net.Conn
+		natHoleConn, err = v.natHole(conn)
+		if err != nil {
+			v.logger.Warn("nat hole to %s %s, fall back to nhole-server", v.serverName, err.Error())
+			_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+		} else {
+			v.logger.Info("nat hole to %s %s", v.serverName, natHoleConn.RemoteAddr().String())
+			_ = conn.Close()
+			conn, direct = natHoleConn, true
+		}
+	}
+	if !direct {
+		_, err = v.request(conn, message.CreateVisitorConn, "")
+		if err != nil {
+			return
+		}
+		_ = conn.SetDeadline(time.Time{})
+	}
+	v.add(localConn)
+	v.add(conn)
+	core.Forward(
+		core.WrapConner(localConn, 0, func() (err error) {
+			v.del(localConn)
+			return
+		}),
+		core.WrapConner(conn, 0, func() (err error) {
+			v.del(conn)
+			return
+		}),
+	)
+}
+
+// register authenticates conn with the token like a forward connection.
+func (v *Visitor) register(conn net.Conn) (err error) {
+	var (
+		data     string
+		msgBytes []byte
+		msg      *message.Message
+	)
+	data, err = auth.NewRegisterData(v.token, false)
+	if err != nil {
+		return
+	}
+	msgBytes, _, err = core.EncodeOneMsg("", message.VisitorConn, message.REGISTER, 0, "", data)
+	if err != nil {
+		return
+	}
+	_, err = conn.Write(msgBytes)
+	if err != nil {
+		return
+	}
+	msg, err = core.DecodeOneMsg(conn)
+	if err != nil {
+		return
+	}
+	if msg.Error != 0 {
+		err = fmt.Errorf("register failed %s", msg.ErrorInfo)
+	}
+	return
+}
+
+// request proves the secret key with operation, after CREATE_VISITOR_CONN
+// nhole-server pairs conn with the stcp service.
+func (v *Visitor) request(conn net.Conn, operation, sid string) (resData string, err error) {
+	var (
+		data     string
+		authData string
+		msgBytes []byte
+		msg      *message.Message
+	)
+	authData, err = auth.NewRegisterData(v.secretKey, false)
+	if err != nil {
+		return
+	}
+	data, err = message.MarshalVisitorConnData(&message.VisitorConnData{
+		Name: v.serverName,
+		Auth: authData,
+		Sid:  sid,
+	})
+	if err != nil {
+		return
+	}
+	msgBytes, _, err = core.EncodeOneMsg("", message.VisitorConn, operation, 0, "", data)
+	if err != nil {
+		return
+	}
+	_, err = conn.Write(msgBytes)
+	if err != nil {
+		return
+	}
+	msg, err = core.DecodeOneMsg(conn)
+	if err != nil {
+		return
+	}
+	if msg.Error != 0 {
+		err = fmt.Errorf("%s", msg.ErrorInfo)
+		return
+	}
+	resData = msg.Data
+	return
+}
+
+// natHole asks nhole-server to let the nhole-client of the xtcp service punch
+// to this visitor, the direct stream is encrypted with the secret key.
+func (v *Visitor) natHole(conn net.Conn) (direct net.Conn, err error) {
+	var (
+		sid         string
+		resData     string
+		natHoleData *message.NatHoleData
+	)
+	sid, err = core.NewSalt()
+	if err != nil {
+		return
+	}
+	resData, err = v.request(conn, message.NatHole, sid)
+	if err != nil {
+		return
+	}
+	natHoleData, err = message.UnmarshalNatHoleData(resData)
+	if err != nil {
+		return
+	}
+	direct, err = newNatHoleConn(v.ip, natHoleData.Port, message.VisitorConn, sid)
+	if err != nil {
+		return
+	}
+	// nhole-client is the client side of the encryption like a forward connection
+	cryptoConn, err := core.WrapCryptoConner(direct, v.secretKey, sid, false)
+	if err != nil {
+		_ = direct.Close()
+		direct = nil
+		return
+	}
+	direct = cryptoConn
+	return
+}
+
+func (v *Visitor) add(conn net.Conn) {
+	v.Lock()
+	defer v.Unlock()
+	v.conns[conn] = struct{}{}
+}
+
+func (v *Visitor) del(conn net.Conn) {
+	v.Lock()
+	defer v.Unlock()
+	delete(v.conns, conn)
+}
+
+func (v *Visitor) Close() (err error) {
+	err = v.Listener.Close()
+	v.Lock()
+	conns := v.conns
+	v.conns = make(map[net.Conn]struct{}, 0)
+	v.Unlock()
+	for conn := range conns {
+		_ = conn.Close()
+	}
+	return
+}
@@ -0,0 +1,43 @@
+package core
+
+import (
+	"compress/flate"
+	"io"
+	"net"
+	"sync"
+)
+
+// CompressConn compresses a stream conn with flate, every Write is flushed
+// so that interactive protocols are not held back by the compressor.
+type CompressConn struct {
+	net.Conn
+	reader io.ReadCloser
+	writer *flate.Writer
+	wLock  sync.Mutex
+}
+
+func WrapCompressConner(conn net.Conn) (conner *CompressConn) {
+	// BestSpeed never fails to create a writer
+	writer, _ := flate.NewWriter(conn, flate.BestSpeed)
+	conner = &CompressConn{
+		Conn:   conn,
+		reader: flate.NewReader(conn),
+		writer: writer,
+	}
+	return
+}
+
+func (c *CompressConn) Read(b []byte) (n int, err error) {
+	return c.reader.Read(b)
+}
+
+func (c *CompressConn) Write(b []byte) (n int, err error) {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+	n, err = c.writer.Write(b)
+	if err != nil {
+		return
+	}
+	err = c.writer.Flush()
+	return
+}
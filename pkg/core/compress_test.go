@@ -0,0 +1,28 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestCompressConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	conn1, conn2 := WrapCompressConner(c1), WrapCompressConner(c2)
+	defer conn1.Close()
+	defer conn2.Close()
+	for _, want := range [][]byte{[]byte("GET / HTTP/1.1\r\n"), bytes.Repeat([]byte("nhole "), 10000)} {
+		go func(b []byte) {
+			_, _ = conn1.Write(b)
+		}(want)
+		// every write is flushed, so the reader sees it without more data
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(conn2, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %d bytes, want %d", len(got), len(want))
+		}
+	}
+}
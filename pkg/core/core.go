@@ -1,6 +1,8 @@
 package core
 
 import (
+	"crypto/tls"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
@@ -8,6 +10,7 @@ import (
 	"time"
 
 	"github.com/biandc/nhole/pkg/core/tcp"
+	"github.com/biandc/nhole/pkg/core/udp"
 	"github.com/biandc/nhole/pkg/message"
 	"github.com/biandc/nhole/pkg/tools"
 )
@@ -16,12 +19,42 @@ const (
 	PackageHeadLen = message.PackageHeadLen
 )
 
-func NewListener(ip string, port int) (listener net.Listener, err error) {
-	return tcp.NewTcpListener(ip, port)
+// NewListener listens on tcp, tlsConfig nil means plaintext.
+func NewListener(ip string, port int, tlsConfig *tls.Config) (listener net.Listener, err error) {
+	listener, err = tcp.NewTcpListener(ip, port)
+	if err != nil || tlsConfig == nil {
+		return
+	}
+	listener = tls.NewListener(listener, tlsConfig)
+	return
+}
+
+// NewConner dials tcp, tlsConfig nil means plaintext.
+func NewConner(ip string, port int, tlsConfig *tls.Config) (conn net.Conn, err error) {
+	conn, err = tcp.NewConner(ip, port)
+	if err != nil || tlsConfig == nil {
+		return
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	_ = tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+	err = tlsConn.Handshake()
+	if err != nil {
+		_ = conn.Close()
+		conn = nil
+		return
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+	conn = tlsConn
+	return
+}
+
+// NewUdpListener accepts one net.Conn per udp visitor address.
+func NewUdpListener(ip string, port int) (listener net.Listener, err error) {
+	return udp.NewUdpListener(ip, port, udp.DefaultIdleTimeout)
 }
 
-func NewConner(ip string, port int) (conn net.Conn, err error) {
-	return tcp.NewConner(ip, port)
+func NewUdpConner(ip string, port int) (conn net.Conn, err error) {
+	return udp.NewConner(ip, port)
 }
 
 func DecodeOneMsg(reader io.Reader) (msg *message.Message, err error) {
@@ -149,18 +182,94 @@ func EncodeOneMsg(
 	return
 }
 
+// Counter counts forwarded bytes, such as a metrics.Value.
+type Counter interface {
+	Add(delta float64)
+}
+
+// Limiter shapes forwarded bytes, such as a tools.RateLimiter.
+type Limiter interface {
+	// Burst is the largest read worth taking at once, 0 is unlimited.
+	Burst() int
+	// WaitN blocks until n more bytes fit in the rate.
+	WaitN(n int)
+}
+
+// Pipe counts and shapes the bytes read from one side of Forward.
+type Pipe struct {
+	Counter  Counter
+	Limiters []Limiter
+	// Datagram reads keep whole datagrams, a burst never truncates them
+	Datagram bool
+}
+
 func Forward(clienter1, clienter2 io.ReadWriteCloser) {
-	var forward = func(from, to io.ReadWriteCloser) {
+	ForwardPipe(clienter1, clienter2, Pipe{}, Pipe{})
+}
+
+// ForwardCount is Forward that adds the bytes read from clienter1 to
+// counter1 and the bytes read from clienter2 to counter2, nil counts nothing.
+func ForwardCount(clienter1, clienter2 io.ReadWriteCloser, counter1, counter2 Counter) {
+	ForwardPipe(clienter1, clienter2, Pipe{Counter: counter1}, Pipe{Counter: counter2})
+}
+
+// ForwardPipe is Forward that applies pipe1 to the bytes read from clienter1
+// and pipe2 to the bytes read from clienter2.
+func ForwardPipe(clienter1, clienter2 io.ReadWriteCloser, pipe1, pipe2 Pipe) {
+	var forward = func(from, to io.ReadWriteCloser, pipe Pipe) {
 		buf := tools.GetBuf(16 * 1024)
 		defer tools.PutBuf(buf)
 		defer func() {
 			_ = from.Close()
 			_ = to.Close()
 		}()
-		_, _ = io.CopyBuffer(to, from, buf)
+		var (
+			reader io.Reader = from
+			writer io.Writer = to
+		)
+		if len(pipe.Limiters) > 0 {
+			reader = &limitReader{Reader: from, limiters: pipe.Limiters, datagram: pipe.Datagram}
+		}
+		if pipe.Counter != nil {
+			writer = &countWriter{Writer: to, counter: pipe.Counter}
+		}
+		_, _ = io.CopyBuffer(writer, reader, buf)
+	}
+	go forward(clienter1, clienter2, pipe1)
+	go forward(clienter2, clienter1, pipe2)
+}
+
+type countWriter struct {
+	io.Writer
+	counter Counter
+}
+
+func (c *countWriter) Write(b []byte) (n int, err error) {
+	n, err = c.Writer.Write(b)
+	c.counter.Add(float64(n))
+	return
+}
+
+// limitReader reads no more than the smallest burst at once and waits for
+// every limiter after each read, so the copy buffer is never written faster
+// than the rate. A datagram is read whole and charged after it.
+type limitReader struct {
+	io.Reader
+	limiters []Limiter
+	datagram bool
+}
+
+func (l *limitReader) Read(b []byte) (n int, err error) {
+	for _, limiter := range l.limiters {
+		if burst := limiter.Burst(); !l.datagram && burst > 0 && len(b) > burst {
+			b = b[:burst]
+		}
+	}
+	n, err = l.Reader.Read(b)
+	for _, limiter := range l.limiters {
+		limiter.WaitN(n)
 	}
-	go forward(clienter1, clienter2)
-	go forward(clienter2, clienter1)
+	return
 }
 
 type Conn struct {
@@ -222,3 +331,52 @@ func (c *Conn) SetCloseFn(closeFn func() (err error)) {
 	defer c.Unlock()
 	c.closeFn = closeFn
 }
+
+// DatagramConn keeps datagram boundaries over a stream conn, every Write
+// is sent as one length prefixed frame and every Read returns one frame.
+type DatagramConn struct {
+	net.Conn
+	header []byte
+}
+
+func WrapDatagramConner(conn net.Conn) (conner *DatagramConn) {
+	conner = &DatagramConn{
+		Conn:   conn,
+		header: make([]byte, 2),
+	}
+	return
+}
+
+func (d *DatagramConn) Read(b []byte) (n int, err error) {
+	_, err = io.ReadFull(d.Conn, d.header)
+	if err != nil {
+		return
+	}
+	size := int(binary.BigEndian.Uint16(d.header))
+	if size > len(b) {
+		// the datagram does not fit, truncate it like a udp socket
+		buf := tools.GetBuf(size)
+		defer tools.PutBuf(buf)
+		_, err = io.ReadFull(d.Conn, buf)
+		n = copy(b, buf)
+		return
+	}
+	n, err = io.ReadFull(d.Conn, b[:size])
+	return
+}
+
+func (d *DatagramConn) Write(b []byte) (n int, err error) {
+	if len(b) > 0xffff {
+		err = fmt.Errorf("datagram too large %d", len(b))
+		return
+	}
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	_, err = d.Conn.Write(frame)
+	if err != nil {
+		return
+	}
+	n = len(b)
+	return
+}
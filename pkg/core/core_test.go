@@ -0,0 +1,65 @@
+package core
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+type countLimiter struct {
+	burst int
+	taken int
+}
+
+func (c *countLimiter) Burst() int {
+	return c.burst
+}
+
+func (c *countLimiter) WaitN(n int) {
+	c.taken += n
+}
+
+func TestLimitReader(t *testing.T) {
+	datagram := bytes.Repeat([]byte("nhole "), 1000)
+	for _, isDatagram := range []bool{false, true} {
+		limiter := &countLimiter{burst: 1024}
+		l := &limitReader{Reader: bytes.NewReader(datagram), limiters: []Limiter{limiter}, datagram: isDatagram}
+		n, err := l.Read(make([]byte, 16*1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := limiter.burst
+		if isDatagram {
+			// a datagram over the burst is read whole and charged whole
+			want = len(datagram)
+		}
+		if n != want || limiter.taken != want {
+			t.Fatalf("datagram %t read %d and took %d, want %d", isDatagram, n, limiter.taken, want)
+		}
+	}
+}
+
+func TestDatagramConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	conn1, conn2 := WrapDatagramConner(c1), WrapDatagramConner(c2)
+	defer conn1.Close()
+	defer conn2.Close()
+	go func() {
+		for _, datagram := range []string{"ping", "nhole datagram"} {
+			_, _ = conn1.Write([]byte(datagram))
+		}
+	}()
+	buf := make([]byte, 1024)
+	n, err := conn2.Read(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("read %q %v", buf[:n], err)
+	}
+	// a datagram larger than the buffer is truncated like a udp socket
+	n, err = conn2.Read(buf[:5])
+	if err != nil || string(buf[:n]) != "nhole" {
+		t.Fatalf("read %q %v", buf[:n], err)
+	}
+	if _, err = conn1.Write(make([]byte, 0x10000)); err == nil {
+		t.Fatal("datagram over 64KB written")
+	}
+}
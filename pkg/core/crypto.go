@@ -0,0 +1,152 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/biandc/nhole/pkg/tools"
+)
+
+const (
+	// cryptoFrameSize is the largest plaintext sealed in one frame.
+	cryptoFrameSize = 16 * 1024
+	// SaltLen is the length of the hex salt of an encrypted forward connection.
+	SaltLen = 32
+)
+
+// NewSalt returns a random hex salt for WrapCryptoConner.
+func NewSalt() (salt string, err error) {
+	b := make([]byte, SaltLen/2)
+	_, err = rand.Read(b)
+	if err != nil {
+		return
+	}
+	salt = hex.EncodeToString(b)
+	return
+}
+
+func deriveKey(token, salt, direction string) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte("nhole encryption "))
+	mac.Write([]byte(salt))
+	mac.Write([]byte(direction))
+	return mac.Sum(nil)
+}
+
+func newAEAD(key []byte) (aead cipher.AEAD, err error) {
+	var block cipher.Block
+	block, err = aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+	aead, err = cipher.NewGCM(block)
+	return
+}
+
+// CryptoConn encrypts a stream conn with AES-256-GCM keyed from the token and
+// a per-connection salt, every Write is sent as length prefixed sealed frames.
+// Each direction has its own key, so counter nonces never repeat.
+type CryptoConn struct {
+	net.Conn
+
+	reader     cipher.AEAD
+	readNonce  []byte
+	header     []byte
+	frame      []byte
+	plain      []byte
+	writer     cipher.AEAD
+	writeNonce []byte
+	wLock      sync.Mutex
+}
+
+// WrapCryptoConner wraps conn, nhole-client and nhole-server must agree on
+// token and salt and pass opposite isClient.
+func WrapCryptoConner(conn net.Conn, token, salt string, isClient bool) (conner *CryptoConn, err error) {
+	if len(salt) != SaltLen {
+		err = fmt.Errorf("bad encryption salt %s", salt)
+		return
+	}
+	readDirection, writeDirection := "server", "client"
+	if !isClient {
+		readDirection, writeDirection = writeDirection, readDirection
+	}
+	conner = &CryptoConn{
+		Conn:   conn,
+		header: make([]byte, 2),
+	}
+	conner.reader, err = newAEAD(deriveKey(token, salt, readDirection))
+	if err != nil {
+		return
+	}
+	conner.writer, err = newAEAD(deriveKey(token, salt, writeDirection))
+	if err != nil {
+		return
+	}
+	conner.readNonce = make([]byte, conner.reader.NonceSize())
+	conner.writeNonce = make([]byte, conner.writer.NonceSize())
+	conner.frame = make([]byte, cryptoFrameSize+conner.reader.Overhead())
+	return
+}
+
+func increaseNonce(nonce []byte) {
+	n := len(nonce)
+	binary.BigEndian.PutUint64(nonce[n-8:], binary.BigEndian.Uint64(nonce[n-8:])+1)
+}
+
+func (c *CryptoConn) Read(b []byte) (n int, err error) {
+	if len(c.plain) == 0 {
+		_, err = io.ReadFull(c.Conn, c.header)
+		if err != nil {
+			return
+		}
+		size := int(binary.BigEndian.Uint16(c.header))
+		if size > len(c.frame) {
+			err = fmt.Errorf("encrypted frame too large %d", size)
+			return
+		}
+		_, err = io.ReadFull(c.Conn, c.frame[:size])
+		if err != nil {
+			return
+		}
+		c.plain, err = c.reader.Open(c.frame[:0], c.readNonce, c.frame[:size], nil)
+		if err != nil {
+			return
+		}
+		increaseNonce(c.readNonce)
+	}
+	n = copy(b, c.plain)
+	c.plain = c.plain[n:]
+	return
+}
+
+func (c *CryptoConn) Write(b []byte) (n int, err error) {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+	buf := tools.GetBuf(2 + cryptoFrameSize + c.writer.Overhead())
+	defer tools.PutBuf(buf)
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > cryptoFrameSize {
+			chunk = chunk[:cryptoFrameSize]
+		}
+		sealed := c.writer.Seal(buf[2:2], c.writeNonce, chunk, nil)
+		increaseNonce(c.writeNonce)
+		binary.BigEndian.PutUint16(buf, uint16(len(sealed)))
+		_, err = c.Conn.Write(buf[:2+len(sealed)])
+		if err != nil {
+			return
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return
+}
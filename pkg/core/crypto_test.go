@@ -0,0 +1,45 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestCryptoConn(t *testing.T) {
+	salt, err := NewSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	client, err := WrapCryptoConner(c1, "secret", salt, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := WrapCryptoConner(c2, "secret", salt, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bytes.Repeat([]byte("nhole "), 10000)
+	go func() {
+		_, _ = client.Write(want)
+	}()
+	got := make([]byte, len(want))
+	if _, err = io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("decrypted data differs")
+	}
+
+	c1, c2 = net.Pipe()
+	client, _ = WrapCryptoConner(c1, "secret", salt, true)
+	server, _ = WrapCryptoConner(c2, "other", salt, false)
+	go func() {
+		_, _ = client.Write([]byte("hello"))
+	}()
+	if _, err = server.Read(got); err == nil {
+		t.Fatal("wrong token decrypted")
+	}
+}
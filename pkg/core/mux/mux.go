@@ -0,0 +1,222 @@
+package mux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Frame layout: version(1) cmd(1) length(2) streamID(4) payload(length).
+
+const (
+	version = 1
+
+	headerSize    = 8
+	maxFrameSize  = 16 * 1024
+	initialWindow = 256 * 1024
+	acceptBacklog = 256
+)
+
+const (
+	cmdSYN byte = iota // open a stream
+	cmdFIN             // close a stream
+	cmdPSH             // stream data
+	cmdUPD             // stream receive window update
+)
+
+var (
+	ErrSessionClosed = fmt.Errorf("mux session closed")
+)
+
+type Session struct {
+	conn net.Conn
+
+	nextID  uint32
+	streams map[uint32]*Stream
+	sync.Mutex
+
+	acceptCh  chan *Stream
+	writeLock sync.Mutex
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// Client starts a session on the side that dialed conn, it opens odd stream IDs.
+func Client(conn net.Conn) (s *Session) {
+	return newSession(conn, 1)
+}
+
+// Server starts a session on the side that accepted conn, it opens even stream IDs.
+func Server(conn net.Conn) (s *Session) {
+	return newSession(conn, 2)
+}
+
+func newSession(conn net.Conn, nextID uint32) (s *Session) {
+	s = &Session{
+		conn: conn,
+
+		nextID:  nextID,
+		streams: make(map[uint32]*Stream, 0),
+
+		acceptCh: make(chan *Stream, acceptBacklog),
+
+		die: make(chan struct{}),
+	}
+	go s.recvLoop()
+	return
+}
+
+func (s *Session) OpenStream() (stream *Stream, err error) {
+	if s.IsClosed() {
+		err = ErrSessionClosed
+		return
+	}
+	s.Lock()
+	id := s.nextID
+	s.nextID += 2
+	stream = newStream(id, s)
+	s.streams[id] = stream
+	s.Unlock()
+	err = s.writeFrame(cmdSYN, id, nil)
+	if err != nil {
+		s.removeStream(id)
+		stream = nil
+	}
+	return
+}
+
+func (s *Session) AcceptStream() (stream *Stream, err error) {
+	select {
+	case stream = <-s.acceptCh:
+	case <-s.die:
+		err = ErrSessionClosed
+	}
+	return
+}
+
+func (s *Session) NumStreams() (n int) {
+	s.Lock()
+	defer s.Unlock()
+	n = len(s.streams)
+	return
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) Close() (err error) {
+	err = ErrSessionClosed
+	s.dieOnce.Do(func() {
+		close(s.die)
+		err = s.conn.Close()
+		s.Lock()
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream, 0)
+		s.Unlock()
+		for _, stream := range streams {
+			stream.sessionClose()
+		}
+	})
+	return
+}
+
+func (s *Session) getStream(id uint32) (stream *Stream) {
+	s.Lock()
+	defer s.Unlock()
+	stream = s.streams[id]
+	return
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.streams, id)
+}
+
+func (s *Session) writeFrame(cmd byte, id uint32, data []byte) (err error) {
+	if s.IsClosed() {
+		err = ErrSessionClosed
+		return
+	}
+	frame := make([]byte, headerSize+len(data))
+	frame[0] = version
+	frame[1] = cmd
+	binary.BigEndian.PutUint16(frame[2:4], uint16(len(data)))
+	binary.BigEndian.PutUint32(frame[4:8], id)
+	copy(frame[headerSize:], data)
+	s.writeLock.Lock()
+	_, err = s.conn.Write(frame)
+	s.writeLock.Unlock()
+	if err != nil {
+		_ = s.Close()
+	}
+	return
+}
+
+func (s *Session) recvLoop() {
+	defer func() {
+		_ = s.Close()
+	}()
+	header := make([]byte, headerSize)
+	for {
+		_, err := io.ReadFull(s.conn, header)
+		if err != nil {
+			return
+		}
+		if header[0] != version {
+			return
+		}
+		cmd := header[1]
+		length := binary.BigEndian.Uint16(header[2:4])
+		id := binary.BigEndian.Uint32(header[4:8])
+		var payload []byte
+		if length > 0 {
+			payload = make([]byte, length)
+			_, err = io.ReadFull(s.conn, payload)
+			if err != nil {
+				return
+			}
+		}
+		switch cmd {
+		case cmdSYN:
+			s.Lock()
+			if _, ok := s.streams[id]; ok {
+				s.Unlock()
+				continue
+			}
+			stream := newStream(id, s)
+			s.streams[id] = stream
+			s.Unlock()
+			select {
+			case s.acceptCh <- stream:
+			default:
+				_ = stream.Close()
+			}
+		case cmdFIN:
+			if stream := s.getStream(id); stream != nil {
+				s.removeStream(id)
+				stream.remoteClose()
+			}
+		case cmdPSH:
+			// a peer that ignores flow control is a protocol error
+			if stream := s.getStream(id); stream != nil && !stream.pushData(payload) {
+				return
+			}
+		case cmdUPD:
+			if stream := s.getStream(id); stream != nil && len(payload) == 4 {
+				stream.addWindow(binary.BigEndian.Uint32(payload))
+			}
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := Client(c1)
+	server := Server(c2)
+	defer client.Close()
+	defer server.Close()
+
+	data := make([]byte, 4*initialWindow+123)
+	_, _ = rand.Read(data)
+	go func() {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(stream, stream)
+		_ = stream.Close()
+	}()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, _ = stream.Write(data)
+	}()
+	got := make([]byte, len(data))
+	if _, err = io.ReadFull(stream, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("stream data mismatch")
+	}
+	_ = stream.Close()
+	if _, err = stream.Write([]byte("x")); err == nil {
+		t.Fatal("write on closed stream")
+	}
+
+	_ = server.Close()
+	if _, err = client.AcceptStream(); err != ErrSessionClosed {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestStreamReceiveWindow(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	server := Server(c2)
+	defer server.Close()
+
+	writeFrame := func(cmd byte, payload []byte) error {
+		frame := make([]byte, headerSize+len(payload))
+		frame[0], frame[1] = version, cmd
+		binary.BigEndian.PutUint16(frame[2:4], uint16(len(payload)))
+		binary.BigEndian.PutUint32(frame[4:8], 1)
+		copy(frame[headerSize:], payload)
+		_, err := c1.Write(frame)
+		return err
+	}
+	if err := writeFrame(cmdSYN, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+	// the stream is never read, the peer may send initialWindow bytes
+	payload := make([]byte, maxFrameSize)
+	for sent := 0; sent < initialWindow; sent += len(payload) {
+		if err := writeFrame(cmdPSH, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if server.IsClosed() {
+		t.Fatal("session closed within the receive window")
+	}
+	_ = writeFrame(cmdPSH, payload)
+	select {
+	case <-server.die:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not closed after the receive window was overrun")
+	}
+}
@@ -0,0 +1,246 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type Stream struct {
+	id      uint32
+	session *Session
+
+	recvBuf  bytes.Buffer
+	consumed uint32
+	// recvWindow is what the peer may still send before a window update
+	recvWindow uint32
+	sendWindow uint32
+	finRecv    bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	sync.Mutex
+
+	readEvent  chan struct{}
+	writeEvent chan struct{}
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+func newStream(id uint32, session *Session) (s *Stream) {
+	s = &Stream{
+		id:      id,
+		session: session,
+
+		recvWindow: initialWindow,
+		sendWindow: initialWindow,
+
+		readEvent:  make(chan struct{}, 1),
+		writeEvent: make(chan struct{}, 1),
+
+		die: make(chan struct{}),
+	}
+	return
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until event fires, the stream dies or deadline passes.
+func (s *Stream) wait(event chan struct{}, deadline time.Time) (err error) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			err = os.ErrDeadlineExceeded
+			return
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-event:
+	case <-s.die:
+		err = io.ErrClosedPipe
+	case <-timeout:
+		err = os.ErrDeadlineExceeded
+	}
+	return
+}
+
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+func (s *Stream) Session() *Session {
+	return s.session
+}
+
+func (s *Stream) Read(b []byte) (n int, err error) {
+	for {
+		s.Lock()
+		if s.recvBuf.Len() > 0 {
+			var update uint32
+			n, _ = s.recvBuf.Read(b)
+			s.consumed += uint32(n)
+			if s.consumed >= initialWindow/2 {
+				update = s.consumed
+				s.consumed = 0
+				s.recvWindow += update
+			}
+			s.Unlock()
+			if update > 0 {
+				payload := make([]byte, 4)
+				binary.BigEndian.PutUint32(payload, update)
+				_ = s.session.writeFrame(cmdUPD, s.id, payload)
+			}
+			return
+		}
+		finRecv := s.finRecv
+		deadline := s.readDeadline
+		s.Unlock()
+		if finRecv {
+			err = io.EOF
+			return
+		}
+		err = s.wait(s.readEvent, deadline)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *Stream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		select {
+		case <-s.die:
+			err = io.ErrClosedPipe
+			return
+		default:
+		}
+		s.Lock()
+		if s.finRecv {
+			s.Unlock()
+			err = io.ErrClosedPipe
+			return
+		}
+		size := uint32(len(b))
+		if size > maxFrameSize {
+			size = maxFrameSize
+		}
+		if size > s.sendWindow {
+			size = s.sendWindow
+		}
+		s.sendWindow -= size
+		deadline := s.writeDeadline
+		s.Unlock()
+		if size == 0 {
+			err = s.wait(s.writeEvent, deadline)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		err = s.session.writeFrame(cmdPSH, s.id, b[:size])
+		if err != nil {
+			return
+		}
+		n += int(size)
+		b = b[size:]
+	}
+	return
+}
+
+func (s *Stream) Close() (err error) {
+	err = io.ErrClosedPipe
+	s.dieOnce.Do(func() {
+		close(s.die)
+		s.session.removeStream(s.id)
+		err = s.session.writeFrame(cmdFIN, s.id, nil)
+		if err == ErrSessionClosed {
+			err = nil
+		}
+	})
+	return
+}
+
+func (s *Stream) sessionClose() {
+	s.dieOnce.Do(func() {
+		close(s.die)
+	})
+}
+
+func (s *Stream) remoteClose() {
+	s.Lock()
+	s.finRecv = true
+	s.Unlock()
+	notify(s.readEvent)
+	notify(s.writeEvent)
+}
+
+// pushData buffers data received for the stream, it is not ok when the
+// peer overruns the receive window.
+func (s *Stream) pushData(data []byte) (ok bool) {
+	s.Lock()
+	if uint32(len(data)) > s.recvWindow {
+		s.Unlock()
+		return
+	}
+	s.recvWindow -= uint32(len(data))
+	_, _ = s.recvBuf.Write(data)
+	s.Unlock()
+	notify(s.readEvent)
+	ok = true
+	return
+}
+
+func (s *Stream) addWindow(size uint32) {
+	s.Lock()
+	s.sendWindow += size
+	s.Unlock()
+	notify(s.writeEvent)
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return s.session.conn.LocalAddr()
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.session.conn.RemoteAddr()
+}
+
+func (s *Stream) SetDeadline(t time.Time) (err error) {
+	s.Lock()
+	s.readDeadline = t
+	s.writeDeadline = t
+	s.Unlock()
+	notify(s.readEvent)
+	notify(s.writeEvent)
+	return
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) (err error) {
+	s.Lock()
+	s.readDeadline = t
+	s.Unlock()
+	notify(s.readEvent)
+	return
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) (err error) {
+	s.Lock()
+	s.writeDeadline = t
+	s.Unlock()
+	notify(s.writeEvent)
+	return
+}
@@ -0,0 +1,63 @@
+package rudp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// punchInterval paces the punch packets, NATs drop the first ones until
+// both sides have sent outwards.
+const punchInterval = 100 * time.Millisecond
+
+func punchPacket(cmd byte, key string) (b []byte) {
+	b = make([]byte, headerSize+len(key))
+	b[0] = cmd
+	copy(b[headerSize:], key)
+	return
+}
+
+// Punch opens a path through the NATs in front of pc and peer, both sides
+// call it at the same time with the same key. It returns once a punch packet
+// of pc is answered, with the address the answer came from, which a NAT may
+// have changed from peer.
+func Punch(pc net.PacketConn, peer net.Addr, key string, timeout time.Duration) (addr net.Addr, err error) {
+	defer func() {
+		_ = pc.SetReadDeadline(time.Time{})
+	}()
+	punch := punchPacket(cmdPUNCH, key)
+	punchAck := punchPacket(cmdPUNCHACK, key)
+	buf := make([]byte, 64*1024)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		_, err = pc.WriteTo(punch, peer)
+		if err != nil {
+			return
+		}
+		_ = pc.SetReadDeadline(time.Now().Add(punchInterval))
+		for {
+			n, from, readErr := pc.ReadFrom(buf)
+			if errors.Is(readErr, os.ErrDeadlineExceeded) {
+				break
+			}
+			if readErr != nil {
+				err = readErr
+				return
+			}
+			if n < headerSize || string(buf[headerSize:n]) != key {
+				continue
+			}
+			switch buf[0] {
+			case cmdPUNCH:
+				_, _ = pc.WriteTo(punchAck, from)
+			case cmdPUNCHACK:
+				addr = from
+				return
+			}
+		}
+	}
+	err = fmt.Errorf("punching to %s timeout", peer.String())
+	return
+}
@@ -0,0 +1,573 @@
+package rudp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/biandc/nhole/pkg/tools"
+)
+
+// Packet layout: cmd(1) seq(4) ack(4) wnd(2) payload.
+// ack is the next sequence the sender expects and wnd its free receive
+// segments, every packet carries both.
+
+const (
+	headerSize = 11
+	mss        = 1200
+	window     = 512
+
+	initialRTO     = 300 * time.Millisecond
+	minRTO         = 50 * time.Millisecond
+	maxRTO         = 3 * time.Second
+	maxRetransmits = 15
+	fastResend     = 3
+
+	tick          = 10 * time.Millisecond
+	keepalive     = 5 * time.Second
+	idleTimeout   = 30 * time.Second
+	lingerTimeout = 10 * time.Second
+	// closeWait keeps a finished stream to acknowledge a retransmitted FIN
+	closeWait = 2 * time.Second
+)
+
+const (
+	cmdPSH      byte = iota // stream data
+	cmdFIN                  // end of stream, takes a sequence number like data
+	cmdACK                  // acknowledges the segment seq
+	cmdUPD                  // carries ack and wnd only
+	cmdPING                 // asks for an UPD, keepalive and window probe
+	cmdRST                  // aborts the stream
+	cmdPUNCH                // nat hole punching, see Punch
+	cmdPUNCHACK             // answers a PUNCH
+)
+
+var (
+	ErrTimeout = fmt.Errorf("rudp peer timeout")
+	ErrReset   = fmt.Errorf("rudp stream reset by peer")
+)
+
+type segment struct {
+	seq    uint32
+	data   []byte
+	fin    bool
+	sentAt time.Time
+	rto    time.Duration
+	xmit   int
+	skips  int
+	acked  bool
+}
+
+// Conn is a reliable ordered stream with one peer over a packet conn, it
+// retransmits lost segments selectively and follows the receive window of
+// the peer. Conn owns pc and closes it once the stream is over.
+type Conn struct {
+	pc   net.PacketConn
+	peer net.Addr
+
+	sndUna uint32
+	sndNxt uint32
+	sndBuf []*segment
+	rmtWnd uint32
+	srtt   time.Duration
+	rttvar time.Duration
+	rto    time.Duration
+
+	rcvNxt  uint32
+	rcvOoo  map[uint32]*segment
+	recvBuf bytes.Buffer
+	finRecv bool
+	advWnd  uint32
+
+	closed    bool
+	closedAt  time.Time
+	doneAt    time.Time
+	lastSend  time.Time
+	lastRecv  time.Time
+	lastProbe time.Time
+	err       error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	sync.Mutex
+
+	readEvent  chan struct{}
+	writeEvent chan struct{}
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// NewConn starts a stream with peer, both sides call it after Punch.
+func NewConn(pc net.PacketConn, peer net.Addr) (c *Conn) {
+	now := time.Now()
+	c = &Conn{
+		pc:   pc,
+		peer: peer,
+
+		rmtWnd: window,
+		rto:    initialRTO,
+
+		rcvOoo: make(map[uint32]*segment, 0),
+		advWnd: window,
+
+		lastSend: now,
+		lastRecv: now,
+
+		readEvent:  make(chan struct{}, 1),
+		writeEvent: make(chan struct{}, 1),
+
+		die: make(chan struct{}),
+	}
+	go c.recvLoop()
+	go c.timerLoop()
+	return
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// before reports whether sequence a comes before b, it survives wrapping.
+func before(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// output sends one packet to the peer, the caller holds the lock.
+func (c *Conn) output(cmd byte, seq uint32, payload []byte) {
+	buf := tools.GetBuf(headerSize + len(payload))
+	defer tools.PutBuf(buf)
+	wnd := c.rcvWnd()
+	buf[0] = cmd
+	binary.BigEndian.PutUint32(buf[1:], seq)
+	binary.BigEndian.PutUint32(buf[5:], c.rcvNxt)
+	binary.BigEndian.PutUint16(buf[9:], uint16(wnd))
+	copy(buf[headerSize:], payload)
+	_, _ = c.pc.WriteTo(buf[:headerSize+len(payload)], c.peer)
+	c.advWnd = wnd
+	c.lastSend = time.Now()
+}
+
+// rcvWnd is the number of segments the receive buffers can still take.
+func (c *Conn) rcvWnd() uint32 {
+	used := uint32(len(c.rcvOoo)) + uint32((c.recvBuf.Len()+mss-1)/mss)
+	if used >= window {
+		return 0
+	}
+	return window - used
+}
+
+func (c *Conn) sendSegment(data []byte, fin bool) {
+	seg := &segment{
+		seq:    c.sndNxt,
+		data:   data,
+		fin:    fin,
+		sentAt: time.Now(),
+		rto:    c.rto,
+		xmit:   1,
+	}
+	c.sndBuf = append(c.sndBuf, seg)
+	c.sndNxt++
+	c.resend(seg)
+}
+
+func (c *Conn) resend(seg *segment) {
+	cmd := cmdPSH
+	if seg.fin {
+		cmd = cmdFIN
+	}
+	c.output(cmd, seg.seq, seg.data)
+}
+
+func (c *Conn) sampleRTT(rtt time.Duration) {
+	if c.srtt == 0 {
+		c.srtt, c.rttvar = rtt, rtt/2
+	} else {
+		delta := c.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttvar = (3*c.rttvar + delta) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	c.rto = c.srtt + 4*c.rttvar
+	if c.rto < minRTO {
+		c.rto = minRTO
+	} else if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+}
+
+// handleAck drops the segments before ack, which the peer has in order.
+func (c *Conn) handleAck(ack uint32, wnd uint32) {
+	if before(c.sndUna, ack) && !before(c.sndNxt, ack) {
+		now := time.Now()
+		n := int(ack - c.sndUna)
+		for _, seg := range c.sndBuf[:n] {
+			if !seg.acked && seg.xmit == 1 {
+				c.sampleRTT(now.Sub(seg.sentAt))
+			}
+		}
+		c.sndBuf = c.sndBuf[n:]
+		c.sndUna = ack
+	}
+	c.rmtWnd = wnd
+	notify(c.writeEvent)
+}
+
+// handleSack marks seq received and resends the segments it skipped often
+// enough to be lost.
+func (c *Conn) handleSack(seq uint32) {
+	if before(seq, c.sndUna) || !before(seq, c.sndNxt) {
+		return
+	}
+	now := time.Now()
+	n := int(seq - c.sndUna)
+	seg := c.sndBuf[n]
+	if !seg.acked {
+		seg.acked = true
+		if seg.xmit == 1 {
+			c.sampleRTT(now.Sub(seg.sentAt))
+		}
+	}
+	for _, seg = range c.sndBuf[:n] {
+		if seg.acked {
+			continue
+		}
+		seg.skips++
+		if seg.skips >= fastResend {
+			seg.skips = 0
+			seg.xmit++
+			seg.sentAt = now
+			c.resend(seg)
+		}
+	}
+}
+
+// handleData buffers a segment and delivers what is in order, it reports
+// whether the segment is held so that it may be acknowledged.
+func (c *Conn) handleData(seq uint32, payload []byte, fin bool) (held bool) {
+	if before(seq, c.rcvNxt) {
+		return true
+	}
+	if _, ok := c.rcvOoo[seq]; ok {
+		return true
+	}
+	if seq-c.rcvNxt >= c.rcvWnd() {
+		return false
+	}
+	c.rcvOoo[seq] = &segment{
+		seq:  seq,
+		data: append([]byte(nil), payload...),
+		fin:  fin,
+	}
+	for {
+		seg, ok := c.rcvOoo[c.rcvNxt]
+		if !ok {
+			break
+		}
+		delete(c.rcvOoo, c.rcvNxt)
+		c.rcvNxt++
+		if seg.fin {
+			c.finRecv = true
+			notify(c.writeEvent)
+		} else if !c.closed {
+			_, _ = c.recvBuf.Write(seg.data)
+		}
+	}
+	notify(c.readEvent)
+	return true
+}
+
+func (c *Conn) input(b []byte) (err error) {
+	cmd := b[0]
+	seq := binary.BigEndian.Uint32(b[1:])
+	ack := binary.BigEndian.Uint32(b[5:])
+	wnd := uint32(binary.BigEndian.Uint16(b[9:]))
+	payload := b[headerSize:]
+	c.Lock()
+	defer c.Unlock()
+	c.lastRecv = time.Now()
+	switch cmd {
+	case cmdPUNCH:
+		// the peer missed our PUNCHACK in Punch
+		c.output(cmdPUNCHACK, 0, payload)
+		return
+	case cmdPUNCHACK:
+		return
+	case cmdRST:
+		err = ErrReset
+		return
+	}
+	c.handleAck(ack, wnd)
+	switch cmd {
+	case cmdACK:
+		c.handleSack(seq)
+	case cmdPSH, cmdFIN:
+		if c.handleData(seq, payload, cmd == cmdFIN) {
+			c.output(cmdACK, seq, nil)
+		} else {
+			c.output(cmdUPD, 0, nil)
+		}
+	case cmdPING:
+		c.output(cmdUPD, 0, nil)
+	}
+	return
+}
+
+func (c *Conn) recvLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := c.pc.ReadFrom(buf)
+		if err != nil {
+			c.kill(err)
+			return
+		}
+		if n < headerSize || addr.String() != c.peer.String() {
+			continue
+		}
+		err = c.input(buf[:n])
+		if err != nil {
+			c.kill(err)
+			return
+		}
+	}
+}
+
+// check retransmits, probes and decides whether the stream is over.
+func (c *Conn) check(now time.Time) (err error) {
+	c.Lock()
+	defer c.Unlock()
+	if now.Sub(c.lastRecv) > idleTimeout {
+		err = ErrTimeout
+		return
+	}
+	for _, seg := range c.sndBuf {
+		if seg.acked || now.Sub(seg.sentAt) < seg.rto {
+			continue
+		}
+		if seg.xmit >= maxRetransmits {
+			c.output(cmdRST, 0, nil)
+			err = ErrTimeout
+			return
+		}
+		seg.xmit++
+		seg.sentAt = now
+		seg.rto *= 2
+		if seg.rto > maxRTO {
+			seg.rto = maxRTO
+		}
+		c.resend(seg)
+	}
+	if c.closed {
+		if c.sndUna == c.sndNxt && c.finRecv {
+			if c.doneAt.IsZero() {
+				c.doneAt = now
+			}
+			if now.Sub(c.doneAt) > closeWait {
+				err = io.ErrClosedPipe
+				return
+			}
+		}
+		if now.Sub(c.closedAt) > lingerTimeout {
+			c.output(cmdRST, 0, nil)
+			err = io.ErrClosedPipe
+			return
+		}
+	}
+	if c.advWnd < window/4 && c.rcvWnd() >= window/2 {
+		c.output(cmdUPD, 0, nil)
+	}
+	if c.rmtWnd == 0 && now.Sub(c.lastProbe) >= c.rto {
+		c.lastProbe = now
+		c.output(cmdPING, 0, nil)
+	} else if now.Sub(c.lastSend) >= keepalive {
+		c.output(cmdPING, 0, nil)
+	}
+	return
+}
+
+func (c *Conn) timerLoop() {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.die:
+			return
+		case now := <-ticker.C:
+			err := c.check(now)
+			if err != nil {
+				c.kill(err)
+				return
+			}
+		}
+	}
+}
+
+func (c *Conn) kill(err error) {
+	c.dieOnce.Do(func() {
+		c.Lock()
+		c.err = err
+		c.Unlock()
+		close(c.die)
+		_ = c.pc.Close()
+	})
+}
+
+// wait blocks until event fires, the stream dies or deadline passes.
+func (c *Conn) wait(event chan struct{}, deadline time.Time) (err error) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			err = os.ErrDeadlineExceeded
+			return
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-event:
+	case <-c.die:
+	case <-timeout:
+		err = os.ErrDeadlineExceeded
+	}
+	return
+}
+
+func (c *Conn) Read(b []byte) (n int, err error) {
+	for {
+		c.Lock()
+		if c.closed {
+			c.Unlock()
+			err = io.ErrClosedPipe
+			return
+		}
+		if c.recvBuf.Len() > 0 {
+			n, _ = c.recvBuf.Read(b)
+			if c.advWnd < window/4 && c.rcvWnd() >= window/2 {
+				c.output(cmdUPD, 0, nil)
+			}
+			c.Unlock()
+			return
+		}
+		if c.finRecv {
+			c.Unlock()
+			err = io.EOF
+			return
+		}
+		if c.err != nil {
+			err = c.err
+			c.Unlock()
+			return
+		}
+		deadline := c.readDeadline
+		c.Unlock()
+		err = c.wait(c.readEvent, deadline)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *Conn) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		c.Lock()
+		if c.closed || c.finRecv {
+			c.Unlock()
+			err = io.ErrClosedPipe
+			return
+		}
+		if c.err != nil {
+			err = c.err
+			c.Unlock()
+			return
+		}
+		limit := c.rmtWnd
+		if limit > window {
+			limit = window
+		}
+		if c.sndNxt-c.sndUna < limit {
+			size := len(b)
+			if size > mss {
+				size = mss
+			}
+			c.sendSegment(append([]byte(nil), b[:size]...), false)
+			c.Unlock()
+			n += size
+			b = b[size:]
+			continue
+		}
+		deadline := c.writeDeadline
+		c.Unlock()
+		err = c.wait(c.writeEvent, deadline)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Close sends FIN after the queued data and returns, the packet conn is
+// closed once both sides finished or after lingerTimeout.
+func (c *Conn) Close() (err error) {
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		err = io.ErrClosedPipe
+		return
+	}
+	c.closed = true
+	c.closedAt = time.Now()
+	c.recvBuf.Reset()
+	if c.err == nil {
+		c.sendSegment(nil, true)
+	}
+	c.Unlock()
+	notify(c.readEvent)
+	notify(c.writeEvent)
+	return
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.pc.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.peer
+}
+
+func (c *Conn) SetDeadline(t time.Time) (err error) {
+	c.Lock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.Unlock()
+	notify(c.readEvent)
+	notify(c.writeEvent)
+	return
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) (err error) {
+	c.Lock()
+	c.readDeadline = t
+	c.Unlock()
+	notify(c.readEvent)
+	return
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) (err error) {
+	c.Lock()
+	c.writeDeadline = t
+	c.Unlock()
+	notify(c.writeEvent)
+	return
+}
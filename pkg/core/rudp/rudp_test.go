@@ -0,0 +1,153 @@
+package rudp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// lossyConn loses and reorders the packets it sends to its peer.
+type lossyConn struct {
+	local pipeAddr
+	peer  *lossyConn
+	in    chan []byte
+	loss  int
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+func newLossyPair(loss int) (a, b *lossyConn) {
+	a = &lossyConn{local: "a", in: make(chan []byte, 4096), loss: loss, die: make(chan struct{})}
+	b = &lossyConn{local: "b", in: make(chan []byte, 4096), loss: loss, die: make(chan struct{})}
+	a.peer, b.peer = b, a
+	return
+}
+
+func (l *lossyConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	select {
+	case b := <-l.in:
+		n = copy(p, b)
+		addr = l.peer.local
+	case <-l.die:
+		err = net.ErrClosed
+	}
+	return
+}
+
+func (l *lossyConn) WriteTo(p []byte, _ net.Addr) (n int, err error) {
+	n = len(p)
+	if mrand.Intn(100) < l.loss {
+		return
+	}
+	b := append([]byte(nil), p...)
+	deliver := func() {
+		select {
+		case l.peer.in <- b:
+		default:
+		}
+	}
+	if mrand.Intn(100) < l.loss {
+		time.AfterFunc(time.Duration(mrand.Intn(20))*time.Millisecond, deliver)
+	} else {
+		deliver()
+	}
+	return
+}
+
+func (l *lossyConn) Close() error {
+	l.dieOnce.Do(func() {
+		close(l.die)
+	})
+	return nil
+}
+
+func (l *lossyConn) LocalAddr() net.Addr                { return l.local }
+func (l *lossyConn) SetDeadline(_ time.Time) error      { return nil }
+func (l *lossyConn) SetReadDeadline(_ time.Time) error  { return nil }
+func (l *lossyConn) SetWriteDeadline(_ time.Time) error { return nil }
+
+func TestConn(t *testing.T) {
+	pa, pb := newLossyPair(10)
+	client := NewConn(pa, pb.local)
+	server := NewConn(pb, pa.local)
+	go func() {
+		_, _ = io.Copy(server, server)
+		_ = server.Close()
+	}()
+
+	data := make([]byte, 1024*1024+123)
+	_, _ = rand.Read(data)
+	go func() {
+		_, _ = client.Write(data)
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("stream data mismatch")
+	}
+	_ = client.Close()
+	if _, err := client.Write([]byte("x")); err == nil {
+		t.Fatal("write on closed conn")
+	}
+	select {
+	case <-server.die:
+	case <-time.After(8 * time.Second):
+		t.Fatal("server did not finish after FIN")
+	}
+}
+
+func TestPunch(t *testing.T) {
+	c1, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		addr, err := Punch(c2, c1.LocalAddr(), "key", 2*time.Second)
+		if err == nil {
+			conn := NewConn(c2, addr)
+			_, err = conn.Write([]byte("hello"))
+		}
+		errCh <- err
+	}()
+	addr, err := Punch(c1, c2.LocalAddr(), "key", 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	conn := NewConn(c1, addr)
+	defer conn.Close()
+	got := make([]byte, 5)
+	if _, err = io.ReadFull(conn, got); err != nil || string(got) != "hello" {
+		t.Fatalf("read %q %v", got, err)
+	}
+
+	// nobody punches from the other side
+	c3, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c3.Close()
+	if _, err = Punch(c3, c2.LocalAddr(), "other", 300*time.Millisecond); err == nil {
+		t.Fatal("punched without a peer")
+	}
+}
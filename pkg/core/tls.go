@@ -0,0 +1,208 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/biandc/nhole/pkg/config"
+	"github.com/biandc/nhole/pkg/log"
+)
+
+const (
+	selfSignedName = "nhole-server"
+)
+
+// Fingerprint returns the hex encoded SHA-256 of a DER certificate.
+func Fingerprint(der []byte) (fingerprint string) {
+	sum := sha256.Sum256(der)
+	fingerprint = hex.EncodeToString(sum[:])
+	return
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+}
+
+// verifyFingerprints pins the peer leaf certificate to one of fingerprints.
+func verifyFingerprints(fingerprints []string) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	pins := make(map[string]struct{}, len(fingerprints))
+	for _, fingerprint := range fingerprints {
+		pins[normalizeFingerprint(fingerprint)] = struct{}{}
+	}
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) (err error) {
+		if len(rawCerts) == 0 {
+			err = fmt.Errorf("tls peer certificate missing")
+			return
+		}
+		fingerprint := Fingerprint(rawCerts[0])
+		if _, ok := pins[fingerprint]; !ok {
+			err = fmt.Errorf("tls peer certificate %s not pinned", fingerprint)
+		}
+		return
+	}
+}
+
+func loadCertPool(caFile string) (pool *x509.CertPool, err error) {
+	var content []byte
+	content, err = os.ReadFile(caFile)
+	if err != nil {
+		return
+	}
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		err = fmt.Errorf("tls ca_file %s has no certificate", caFile)
+	}
+	return
+}
+
+// generateSelfSigned creates an ECDSA certificate for bootstrap setups,
+// it is written to certFile/keyFile when they are set so the fingerprint
+// survives restarts.
+func generateSelfSigned(certFile, keyFile string) (cert tls.Certificate, err error) {
+	var (
+		key      *ecdsa.PrivateKey
+		serial   *big.Int
+		der      []byte
+		keyBytes []byte
+	)
+	key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	serial, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: selfSignedName},
+		DNSNames:              []string{selfSignedName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err = x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+	keyBytes, err = x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+	if certFile != "" && keyFile != "" {
+		err = os.WriteFile(certFile, certPem, 0644)
+		if err != nil {
+			return
+		}
+		err = os.WriteFile(keyFile, keyPem, 0600)
+		if err != nil {
+			return
+		}
+	}
+	cert, err = tls.X509KeyPair(certPem, keyPem)
+	return
+}
+
+func loadServerCert(cfg *config.TLS) (cert tls.Certificate, err error) {
+	if cfg.SelfSigned {
+		_, certErr := os.Stat(cfg.CertFile)
+		_, keyErr := os.Stat(cfg.KeyFile)
+		if cfg.CertFile == "" || os.IsNotExist(certErr) || os.IsNotExist(keyErr) {
+			cert, err = generateSelfSigned(cfg.CertFile, cfg.KeyFile)
+			if err != nil {
+				return
+			}
+			log.Info("generate self-signed certificate sha256 fingerprint %s", Fingerprint(cert.Certificate[0]))
+			return
+		}
+	}
+	cert, err = tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return
+	}
+	log.Info("load certificate sha256 fingerprint %s", Fingerprint(cert.Certificate[0]))
+	return
+}
+
+// NewServerTlsConfig returns nil when tls is disabled. Setting ca_file or
+// fingerprints turns on mutual TLS.
+func NewServerTlsConfig(cfg *config.TLS) (tlsConfig *tls.Config, err error) {
+	if !cfg.Enable {
+		return
+	}
+	var cert tls.Certificate
+	cert, err = loadServerCert(cfg)
+	if err != nil {
+		return
+	}
+	tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if len(cfg.Fingerprints) > 0 {
+		tlsConfig.ClientAuth = tls.RequireAnyClientCert
+		tlsConfig.VerifyPeerCertificate = verifyFingerprints(cfg.Fingerprints)
+	}
+	if cfg.CaFile != "" {
+		tlsConfig.ClientCAs, err = loadCertPool(cfg.CaFile)
+		if err != nil {
+			return
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return
+}
+
+// NewClientTlsConfig returns nil when tls is disabled. Without ca_file the
+// server is verified against fingerprints, or the system roots otherwise.
+func NewClientTlsConfig(cfg *config.TLS, serverIp string) (tlsConfig *tls.Config, err error) {
+	if !cfg.Enable {
+		return
+	}
+	tlsConfig = &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = serverIp
+	}
+	if cfg.CertFile != "" {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.CaFile != "" {
+		tlsConfig.RootCAs, err = loadCertPool(cfg.CaFile)
+		if err != nil {
+			return
+		}
+	}
+	if len(cfg.Fingerprints) > 0 {
+		if cfg.CaFile == "" {
+			// the pinned certificate replaces chain verification
+			tlsConfig.InsecureSkipVerify = true
+		}
+		tlsConfig.VerifyPeerCertificate = verifyFingerprints(cfg.Fingerprints)
+	}
+	return
+}
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/biandc/nhole/pkg/config"
+)
+
+// newTestCert writes a self-signed certificate to dir and returns its files
+// and sha256 fingerprint.
+func newTestCert(t *testing.T, dir, name string) (certFile, keyFile, fingerprint string) {
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	cert, err := generateSelfSigned(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint = Fingerprint(cert.Certificate[0])
+	return
+}
+
+// handshake runs both sides of a tls handshake over loopback tcp, which
+// buffers the alert of the side that fails.
+func handshake(t *testing.T, serverCfg, clientCfg *config.TLS) (serverErr, clientErr error) {
+	serverConfig, err := NewServerTlsConfig(serverCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := NewClientTlsConfig(clientCfg, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		server := tls.Server(conn, serverConfig)
+		defer server.Close()
+		err = server.Handshake()
+		if err == nil {
+			// a tls 1.3 server verifies the client certificate after the
+			// client handshake is done, the client sees it on read
+			_, err = server.Write([]byte("x"))
+		}
+		errCh <- err
+	}()
+	client, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+	if err == nil {
+		_, err = client.Read(make([]byte, 1))
+		_ = client.Close()
+	}
+	clientErr = err
+	serverErr = <-errCh
+	return
+}
+
+func TestTlsFingerprints(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, fingerprint := newTestCert(t, dir, "server")
+	serverCfg := &config.TLS{Enable: true, CertFile: certFile, KeyFile: keyFile}
+
+	// fingerprints are compared without colons and case
+	pinned := strings.ToUpper(fingerprint[:2]) + ":" + fingerprint[2:]
+	serverErr, clientErr := handshake(t, serverCfg, &config.TLS{Enable: true, Fingerprints: []string{pinned}})
+	if serverErr != nil || clientErr != nil {
+		t.Fatalf("pinned handshake %v %v", serverErr, clientErr)
+	}
+
+	_, _, other := newTestCert(t, dir, "other")
+	_, clientErr = handshake(t, serverCfg, &config.TLS{Enable: true, Fingerprints: []string{other}})
+	if clientErr == nil || !strings.Contains(clientErr.Error(), "not pinned") {
+		t.Fatalf("server certificate not pinned accepted %v", clientErr)
+	}
+}
+
+func TestTlsClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, fingerprint := newTestCert(t, dir, "server")
+	clientCert, clientKey, clientFingerprint := newTestCert(t, dir, "client")
+	otherCert, otherKey, _ := newTestCert(t, dir, "other")
+	serverCfg := &config.TLS{Enable: true, CertFile: certFile, KeyFile: keyFile, Fingerprints: []string{clientFingerprint}}
+
+	serverErr, clientErr := handshake(t, serverCfg, &config.TLS{
+		Enable: true, CertFile: clientCert, KeyFile: clientKey, Fingerprints: []string{fingerprint},
+	})
+	if serverErr != nil || clientErr != nil {
+		t.Fatalf("pinned client certificate %v %v", serverErr, clientErr)
+	}
+
+	serverErr, _ = handshake(t, serverCfg, &config.TLS{
+		Enable: true, CertFile: otherCert, KeyFile: otherKey, Fingerprints: []string{fingerprint},
+	})
+	if serverErr == nil || !strings.Contains(serverErr.Error(), "not pinned") {
+		t.Fatalf("client certificate not pinned accepted %v", serverErr)
+	}
+
+	serverErr, _ = handshake(t, serverCfg, &config.TLS{Enable: true, Fingerprints: []string{fingerprint}})
+	if serverErr == nil {
+		t.Fatal("client without certificate accepted")
+	}
+}
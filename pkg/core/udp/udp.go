@@ -0,0 +1,236 @@
+package udp
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultIdleTimeout = 60 * time.Second
+
+	maxDatagramSize = 64 * 1024
+	sessionBacklog  = 128
+	acceptBacklog   = 100
+)
+
+// Listener turns a udp socket into a net.Listener, Accept returns one
+// Session per visitor address.
+type Listener struct {
+	conn        *net.UDPConn
+	idleTimeout time.Duration
+
+	sessions map[string]*Session
+	sync.Mutex
+
+	acceptCh chan *Session
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+func NewUdpListener(ip string, port int, idleTimeout time.Duration) (l *Listener, err error) {
+	var (
+		addr *net.UDPAddr
+		conn *net.UDPConn
+	)
+	addr, err = net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", ip, port))
+	if err != nil {
+		return
+	}
+	conn, err = net.ListenUDP("udp", addr)
+	if err != nil {
+		return
+	}
+	l = &Listener{
+		conn:        conn,
+		idleTimeout: idleTimeout,
+
+		sessions: make(map[string]*Session, 0),
+
+		acceptCh: make(chan *Session, acceptBacklog),
+
+		die: make(chan struct{}),
+	}
+	go l.readLoop()
+	return
+}
+
+func NewConner(ip string, port int) (conn net.Conn, err error) {
+	conn, err = net.DialTimeout("udp", fmt.Sprintf("%s:%d", ip, port), 5*time.Second)
+	return
+}
+
+func (l *Listener) readLoop() {
+	defer func() {
+		_ = l.Close()
+	}()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		datagram := make([]byte, n)
+		copy(datagram, buf[:n])
+		key := addr.String()
+		l.Lock()
+		session, ok := l.sessions[key]
+		if !ok {
+			session = newSession(l, addr)
+			select {
+			case l.acceptCh <- session:
+				l.sessions[key] = session
+			default:
+				// accept backlog full, drop the visitor
+				l.Unlock()
+				continue
+			}
+		}
+		l.Unlock()
+		session.push(datagram)
+	}
+}
+
+func (l *Listener) Accept() (conn net.Conn, err error) {
+	select {
+	case session := <-l.acceptCh:
+		conn = session
+	case <-l.die:
+		err = net.ErrClosed
+	}
+	return
+}
+
+func (l *Listener) Close() (err error) {
+	err = net.ErrClosed
+	l.dieOnce.Do(func() {
+		close(l.die)
+		err = l.conn.Close()
+		l.Lock()
+		sessions := l.sessions
+		l.sessions = make(map[string]*Session, 0)
+		l.Unlock()
+		for _, session := range sessions {
+			_ = session.Close()
+		}
+	})
+	return
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+func (l *Listener) remove(key string) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.sessions, key)
+}
+
+// Session is the datagram conversation with one visitor address, it
+// closes itself after the listener idle timeout without traffic.
+type Session struct {
+	listener *Listener
+	addr     *net.UDPAddr
+
+	readCh     chan []byte
+	lastActive int64
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+func newSession(l *Listener, addr *net.UDPAddr) (s *Session) {
+	s = &Session{
+		listener: l,
+		addr:     addr,
+
+		readCh:     make(chan []byte, sessionBacklog),
+		lastActive: time.Now().UnixNano(),
+
+		die: make(chan struct{}),
+	}
+	return
+}
+
+func (s *Session) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *Session) push(datagram []byte) {
+	s.touch()
+	select {
+	case s.readCh <- datagram:
+	default:
+		// reader is too slow, drop like the network would
+	}
+}
+
+// Read returns one datagram per call.
+func (s *Session) Read(b []byte) (n int, err error) {
+	for {
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+		timer := time.NewTimer(s.listener.idleTimeout - idle)
+		select {
+		case datagram := <-s.readCh:
+			timer.Stop()
+			n = copy(b, datagram)
+			return
+		case <-s.die:
+			timer.Stop()
+			err = io.EOF
+			return
+		case <-timer.C:
+			idle = time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+			if idle >= s.listener.idleTimeout {
+				_ = s.Close()
+				err = io.EOF
+				return
+			}
+		}
+	}
+}
+
+func (s *Session) Write(b []byte) (n int, err error) {
+	select {
+	case <-s.die:
+		err = net.ErrClosed
+		return
+	default:
+	}
+	s.touch()
+	n, err = s.listener.conn.WriteToUDP(b, s.addr)
+	return
+}
+
+func (s *Session) Close() (err error) {
+	s.dieOnce.Do(func() {
+		close(s.die)
+		s.listener.remove(s.addr.String())
+	})
+	return
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	return s.listener.Addr()
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.addr
+}
+
+func (s *Session) SetDeadline(_ time.Time) error {
+	return nil
+}
+
+func (s *Session) SetReadDeadline(_ time.Time) error {
+	return nil
+}
+
+func (s *Session) SetWriteDeadline(_ time.Time) error {
+	return nil
+}
@@ -0,0 +1,100 @@
+package udp
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestConner(t *testing.T, l *Listener) (conn net.Conn) {
+	conn, err := NewConner("127.0.0.1", l.Addr().(*net.UDPAddr).Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return
+}
+
+func TestListenerSessions(t *testing.T) {
+	l, err := NewUdpListener("127.0.0.1", 0, DefaultIdleTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conns := []net.Conn{newTestConner(t, l), newTestConner(t, l)}
+	for i, conn := range conns {
+		// every write is one datagram, a session returns one per read
+		for _, datagram := range []string{"ping", "nhole"} {
+			if _, err = conn.Write([]byte(datagram)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		session, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session.RemoteAddr().String() != conn.LocalAddr().String() {
+			t.Fatalf("visitor %d got the session of %s", i, session.RemoteAddr())
+		}
+		buf := make([]byte, 1024)
+		for _, want := range []string{"ping", "nhole"} {
+			n, err := session.Read(buf)
+			if err != nil || string(buf[:n]) != want {
+				t.Fatalf("visitor %d read %q %v, want %q", i, buf[:n], err, want)
+			}
+		}
+		if _, err = session.Write([]byte("pong")); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil || string(buf[:n]) != "pong" {
+			t.Fatalf("visitor %d got %q %v", i, buf[:n], err)
+		}
+	}
+	_ = l.Close()
+	if _, err = l.Accept(); err != net.ErrClosed {
+		t.Fatalf("accept on a closed listener %v", err)
+	}
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	l, err := NewUdpListener("127.0.0.1", 0, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn := newTestConner(t, l)
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	session, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	if _, err = session.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err = session.Read(buf); err != io.EOF {
+		t.Fatalf("idle session read %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("idle session closed after %s", d)
+	}
+	// the next datagram of the address opens a new session
+	if _, err = conn.Write([]byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	next, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == session {
+		t.Fatal("closed session reused")
+	}
+}
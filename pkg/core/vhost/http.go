@@ -0,0 +1,134 @@
+package vhost
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"time"
+
+	"github.com/biandc/nhole/pkg/log"
+)
+
+type ctxKey int
+
+const (
+	remoteAddrKey ctxKey = iota
+)
+
+const (
+	notFoundPage = `<!DOCTYPE html>
+<html>
+<head><title>404 Not Found</title></head>
+<body>
+<h1>404 Not Found</h1>
+<p>The page you requested was not found.</p>
+<hr><p>nhole</p>
+</body>
+</html>
+`
+	badGatewayPage = `<!DOCTYPE html>
+<html>
+<head><title>502 Bad Gateway</title></head>
+<body>
+<h1>502 Bad Gateway</h1>
+<p>The service behind this domain is unavailable.</p>
+<hr><p>nhole</p>
+</body>
+</html>
+`
+)
+
+// HttpMuxer routes http requests on a shared listener by their Host header,
+// keep-alive and websocket upgrades are handled by the reverse proxy. Each
+// request gets a new pipe to its service, so that the forward server sees the
+// address of every visitor for allow_ips, deny_ips and max_connections.
+type HttpMuxer struct {
+	*Router
+
+	listener net.Listener
+	server   *http.Server
+	proxy    *httputil.ReverseProxy
+}
+
+func NewHttpMuxer(listener net.Listener) (m *HttpMuxer) {
+	m = &HttpMuxer{
+		Router:   NewRouter(listener.Addr()),
+		listener: listener,
+	}
+	m.proxy = &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = req.Host
+		},
+		Transport: &http.Transport{
+			DialContext: m.dial,
+			// a pooled pipe keeps the address of the visitor that dialed it
+			DisableKeepAlives:  true,
+			DisableCompression: true,
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			log.Warn("vhost http %s %s", req.Host, err.Error())
+			writePage(w, http.StatusBadGateway, badGatewayPage)
+		},
+	}
+	m.server = &http.Server{
+		Handler:           m,
+		ReadHeaderTimeout: 60 * time.Second,
+	}
+	return
+}
+
+func writePage(w http.ResponseWriter, code int, page string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	_, _ = w.Write([]byte(page))
+}
+
+func (m *HttpMuxer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if _, ok := m.Get(req.Host); !ok {
+		writePage(w, http.StatusNotFound, notFoundPage)
+		return
+	}
+	ctx := context.WithValue(req.Context(), remoteAddrKey, req.RemoteAddr)
+	m.proxy.ServeHTTP(w, req.WithContext(ctx))
+}
+
+// dial hands one end of an in-memory pipe to the virtual listener of addr.
+func (m *HttpMuxer) dial(ctx context.Context, _, addr string) (c net.Conn, err error) {
+	l, ok := m.Get(addr)
+	if !ok {
+		err = fmt.Errorf("vhost domain %s not registered", addr)
+		return
+	}
+	var remoteAddr net.Addr
+	if addrStr, ok := ctx.Value(remoteAddrKey).(string); ok {
+		remoteAddr, _ = net.ResolveTCPAddr("tcp", addrStr)
+	}
+	local, remote := net.Pipe()
+	err = l.Put(WrapConn(remote, remoteAddr))
+	if err != nil {
+		_ = local.Close()
+		_ = remote.Close()
+		return
+	}
+	c = local
+	return
+}
+
+func (m *HttpMuxer) Serve() (err error) {
+	err = m.server.Serve(m.listener)
+	return
+}
+
+// Shutdown stops accepting visitors and waits for active requests until ctx is done.
+func (m *HttpMuxer) Shutdown(ctx context.Context) (err error) {
+	err = m.server.Shutdown(ctx)
+	return
+}
+
+func (m *HttpMuxer) Close() (err error) {
+	err = m.server.Close()
+	return
+}
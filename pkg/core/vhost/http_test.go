@@ -0,0 +1,107 @@
+package vhost
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestHttpMuxer(t *testing.T) (m *HttpMuxer) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = NewHttpMuxer(listener)
+	go func() {
+		_ = m.Serve()
+	}()
+	t.Cleanup(func() {
+		_ = m.Close()
+	})
+	return
+}
+
+// serveRemoteAddr answers every request with the remote address of the
+// connection it came on.
+func serveRemoteAddr(t *testing.T, l net.Listener) {
+	go func() {
+		_ = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, _ = io.WriteString(w, req.RemoteAddr)
+		}))
+	}()
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+}
+
+func TestHttpMuxerRemoteAddr(t *testing.T) {
+	m := newTestHttpMuxer(t)
+	l, err := m.Listen([]string{"www.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveRemoteAddr(t, l)
+	url := "http://" + m.listener.Addr().String() + "/"
+	for _, ip := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.1"} {
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: (&net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}).DialContext,
+		}}
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Host = "www.example.com"
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		client.CloseIdleConnections()
+		if host, _, _ := net.SplitHostPort(string(body)); host != ip {
+			t.Fatalf("request of visitor %s reached the service from %s", ip, body)
+		}
+	}
+}
+
+func TestHttpMuxerRoute(t *testing.T) {
+	m := newTestHttpMuxer(t)
+	l, err := m.Listen([]string{"www.example.com", "*.example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveRemoteAddr(t, l)
+	down, err := m.Listen([]string{"down.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		// the service behind down.example.com drops every connection
+		for {
+			conn, err := down.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	defer down.Close()
+	for host, code := range map[string]int{
+		"www.example.com":      http.StatusOK,
+		"WWW.example.com:8080": http.StatusOK,
+		"a.b.example.org":      http.StatusOK,
+		"example.org":          http.StatusNotFound,
+		"example.com":          http.StatusNotFound,
+		"down.example.com":     http.StatusBadGateway,
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = host
+		m.ServeHTTP(w, req)
+		if w.Code != code {
+			t.Fatalf("%s = %d, want %d", host, w.Code, code)
+		}
+		if code != http.StatusOK && w.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+			t.Fatalf("%s has no error page", host)
+		}
+	}
+}
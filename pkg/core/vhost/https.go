@@ -0,0 +1,141 @@
+package vhost
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/biandc/nhole/pkg/log"
+)
+
+// HttpsMuxer routes tls connections on a shared listener by the SNI of
+// their ClientHello, the stream is never decrypted.
+type HttpsMuxer struct {
+	*Router
+
+	listener net.Listener
+}
+
+func NewHttpsMuxer(listener net.Listener) (m *HttpsMuxer) {
+	m = &HttpsMuxer{
+		Router:   NewRouter(listener.Addr()),
+		listener: listener,
+	}
+	return
+}
+
+func (m *HttpsMuxer) Serve() (err error) {
+	for {
+		var c net.Conn
+		c, err = m.listener.Accept()
+		if err != nil {
+			return
+		}
+		go m.handleConn(c)
+	}
+}
+
+func (m *HttpsMuxer) handleConn(c net.Conn) {
+	var (
+		hello  *tls.ClientHelloInfo
+		peeked []byte
+		err    error
+	)
+	defer func() {
+		if err != nil {
+			log.Warn("vhost https %s %s", c.RemoteAddr().String(), err.Error())
+			_ = c.Close()
+		}
+	}()
+	_ = c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	hello, peeked, err = peekClientHello(c)
+	if err != nil {
+		return
+	}
+	_ = c.SetReadDeadline(time.Time{})
+	l, ok := m.Get(hello.ServerName)
+	if !ok {
+		err = fmt.Errorf("vhost domain %s not registered", hello.ServerName)
+		return
+	}
+	err = l.Put(&peekedConn{
+		Conn:   c,
+		reader: io.MultiReader(bytes.NewReader(peeked), c),
+	})
+}
+
+func (m *HttpsMuxer) Close() (err error) {
+	err = m.listener.Close()
+	return
+}
+
+// peekClientHello reads the ClientHello through a throwaway tls server and
+// returns the bytes it consumed so they can be replayed.
+func peekClientHello(c net.Conn) (hello *tls.ClientHelloInfo, peeked []byte, err error) {
+	buf := new(bytes.Buffer)
+	_ = tls.Server(readOnlyConn{reader: io.TeeReader(c, buf)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = new(tls.ClientHelloInfo)
+			*hello = *info
+			return nil, io.EOF
+		},
+	}).Handshake()
+	peeked = buf.Bytes()
+	if hello == nil {
+		err = fmt.Errorf("tls ClientHello not found")
+		return
+	}
+	if hello.ServerName == "" {
+		err = fmt.Errorf("tls ClientHello has no server name")
+	}
+	return
+}
+
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (r readOnlyConn) Read(b []byte) (int, error) {
+	return r.reader.Read(b)
+}
+
+func (r readOnlyConn) Write(_ []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func (r readOnlyConn) Close() error {
+	return nil
+}
+
+func (r readOnlyConn) LocalAddr() net.Addr {
+	return nil
+}
+
+func (r readOnlyConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+func (r readOnlyConn) SetDeadline(_ time.Time) error {
+	return nil
+}
+
+func (r readOnlyConn) SetReadDeadline(_ time.Time) error {
+	return nil
+}
+
+func (r readOnlyConn) SetWriteDeadline(_ time.Time) error {
+	return nil
+}
+
+// peekedConn replays the peeked ClientHello before reading from the visitor.
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (p *peekedConn) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
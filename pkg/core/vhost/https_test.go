@@ -0,0 +1,101 @@
+package vhost
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestCertificate(t *testing.T) (cert tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"www.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return
+}
+
+// dialHttps runs a tls handshake with serverName through the muxer over
+// net.Pipe.
+func dialHttps(m *HttpsMuxer, serverName string) (conn *tls.Conn, err error) {
+	c1, c2 := net.Pipe()
+	go m.handleConn(c2)
+	conn = tls.Client(c1, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	err = conn.Handshake()
+	if err != nil {
+		_ = conn.Close()
+	}
+	return
+}
+
+func TestHttpsMuxerRoute(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewHttpsMuxer(listener)
+	defer m.Close()
+	l, err := m.Listen([]string{"www.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	config := &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}}
+	go func() {
+		// the service terminates tls itself, the peeked ClientHello is replayed
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn *tls.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 4)
+				n, _ := conn.Read(buf)
+				_, _ = conn.Write(buf[:n])
+			}(tls.Server(conn, config))
+		}
+	}()
+
+	conn, err := dialHttps(m, "WWW.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("read %q %v", buf[:n], err)
+	}
+	// take the close_notify of the service, net.Pipe does not buffer it
+	if _, err = conn.Read(buf); err != io.EOF {
+		t.Fatalf("service not closed %v", err)
+	}
+
+	for _, serverName := range []string{"example.com", ""} {
+		if conn, err := dialHttps(m, serverName); err == nil {
+			_ = conn.Close()
+			t.Fatalf("server name %q routed", serverName)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package vhost
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Router maps domains to virtual listeners, an exact domain wins over a
+// "*.example.com" wildcard.
+type Router struct {
+	addr   net.Addr
+	routes map[string]*Listener
+	sync.RWMutex
+}
+
+func NewRouter(addr net.Addr) (r *Router) {
+	r = &Router{
+		addr:   addr,
+		routes: make(map[string]*Listener, 0),
+	}
+	return
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+// Listen registers domains and returns the listener that accepts their connections.
+func (r *Router) Listen(domains []string) (l *Listener, err error) {
+	if len(domains) == 0 {
+		err = fmt.Errorf("vhost custom_domains is empty")
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	for _, domain := range domains {
+		if _, ok := r.routes[normalizeDomain(domain)]; ok {
+			err = fmt.Errorf("vhost domain %s already registered", domain)
+			return
+		}
+	}
+	l = &Listener{
+		router:  r,
+		domains: domains,
+		connCh:  make(chan net.Conn, 100),
+		die:     make(chan struct{}),
+	}
+	for _, domain := range domains {
+		r.routes[normalizeDomain(domain)] = l
+	}
+	return
+}
+
+func (r *Router) Addr() net.Addr {
+	return r.addr
+}
+
+func (r *Router) Get(host string) (l *Listener, ok bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = normalizeDomain(host)
+	r.RLock()
+	defer r.RUnlock()
+	if l, ok = r.routes[host]; ok {
+		return
+	}
+	for {
+		i := strings.Index(host, ".")
+		if i < 0 {
+			return
+		}
+		host = host[i+1:]
+		if l, ok = r.routes["*."+host]; ok {
+			return
+		}
+	}
+}
+
+func (r *Router) remove(l *Listener) {
+	r.Lock()
+	defer r.Unlock()
+	for _, domain := range l.domains {
+		if r.routes[normalizeDomain(domain)] == l {
+			delete(r.routes, normalizeDomain(domain))
+		}
+	}
+}
+
+// Listener is a virtual listener fed by a shared vhost listener.
+type Listener struct {
+	router  *Router
+	domains []string
+
+	connCh chan net.Conn
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// Put hands conn to Accept, it fails once the listener is closed.
+func (l *Listener) Put(conn net.Conn) (err error) {
+	select {
+	case <-l.die:
+		err = net.ErrClosed
+		return
+	default:
+	}
+	select {
+	case l.connCh <- conn:
+	case <-l.die:
+		err = net.ErrClosed
+	}
+	return
+}
+
+func (l *Listener) Accept() (conn net.Conn, err error) {
+	select {
+	case conn = <-l.connCh:
+	case <-l.die:
+		err = net.ErrClosed
+	}
+	return
+}
+
+func (l *Listener) Close() (err error) {
+	err = net.ErrClosed
+	l.dieOnce.Do(func() {
+		close(l.die)
+		l.router.remove(l)
+		err = nil
+	})
+	return
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.router.addr
+}
+
+func (l *Listener) Domains() []string {
+	return l.domains
+}
+
+// conn reports the visitor address instead of the in-memory pipe.
+type conn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func WrapConn(c net.Conn, remoteAddr net.Addr) net.Conn {
+	if remoteAddr == nil {
+		return c
+	}
+	return &conn{
+		Conn:       c,
+		remoteAddr: remoteAddr,
+	}
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
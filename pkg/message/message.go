@@ -3,6 +3,8 @@ package message
 import (
 	"encoding/json"
 	"fmt"
+	"regexp"
+	"strconv"
 
 	"github.com/biandc/nhole/pkg/tools"
 )
@@ -13,10 +15,29 @@ const (
 	REGISTER            = "REGISTER"
 	CreateForwardConn   = "CREATE_FORWARD_CONN"
 	CreateForwardServer = "CREATE_FORWARD_SERVER"
+	CloseForwardServer  = "CLOSE_FORWARD_SERVER"
 	HEARTBEAT           = "HEARTBEAT"
+	SHUTDOWN            = "SHUTDOWN"
+	CreateVisitorConn   = "CREATE_VISITOR_CONN"
+	NatHole             = "NAT_HOLE"
+	PoolForwardConn     = "POOL_FORWARD_CONN"
 
 	ControlConn = "CONTROL"
 	ForwardConn = "FORWARD"
+	VisitorConn = "VISITOR"
+
+	TCP   = "tcp"
+	UDP   = "udp"
+	HTTP  = "http"
+	HTTPS = "https"
+	// STCP is a secret tcp service, only reachable through a visitor.
+	STCP = "stcp"
+	// XTCP is a stcp service whose visitors try a direct udp connection first.
+	XTCP = "xtcp"
+
+	// load balancing of the visitors of a group
+	RoundRobin       = "round_robin"
+	LeastConnections = "least_connections"
 )
 
 type Message struct {
@@ -53,14 +74,87 @@ func (m *Message) Validate() (err error) {
 	return
 }
 
+var secretKeyRe = regexp.MustCompile(`"(secret_key|group_key)":"(?:[^"\\]|\\.)*"`)
+
+// String is the message for logs, secret and group keys are hidden.
 func (m *Message) String() (msgStr string) {
-	msgStr = fmt.Sprintf("{clientID:%s,conn_type:%s,operation:%s,error:%d,error_info:%s,data:%s}", m.ClientID, m.ConnType, m.Operation, m.Error, m.ErrorInfo, m.Data)
+	data := secretKeyRe.ReplaceAllString(m.Data, `"$1":"***"`)
+	msgStr = fmt.Sprintf("{clientID:%s,conn_type:%s,operation:%s,error:%d,error_info:%s,data:%s}", m.ClientID, m.ConnType, m.Operation, m.Error, m.ErrorInfo, data)
+	return
+}
+
+type RegisterData struct {
+	Timestamp int64  `json:"timestamp"`
+	Nonce     string `json:"nonce"`
+	Sign      string `json:"sign"`
+	Mux       bool   `json:"mux"`
+}
+
+func NewRegisterData(timestamp int64, nonce, sign string, mux bool) (r *RegisterData) {
+	r = &RegisterData{
+		Timestamp: timestamp,
+		Nonce:     nonce,
+		Sign:      sign,
+		Mux:       mux,
+	}
+	return
+}
+
+func UnmarshalRegisterData(str string) (data *RegisterData, err error) {
+	data = &RegisterData{}
+	err = json.Unmarshal([]byte(str), data)
+	if err != nil {
+		return
+	}
+	return
+}
+
+func MarshalRegisterData(timestamp int64, nonce, sign string, mux bool) (data string, err error) {
+	var bytes []byte
+	bytes, err = json.Marshal(NewRegisterData(timestamp, nonce, sign, mux))
+	if err != nil {
+		return
+	}
+	data = string(bytes)
+	return
+}
+
+// RegisterResData is the data of the REGISTER response.
+type RegisterResData struct {
+	Mux bool `json:"mux"`
+	// Salt keys an encrypted forward connection.
+	Salt string `json:"salt,omitempty"`
+}
+
+func UnmarshalRegisterResData(str string) (data *RegisterResData, err error) {
+	data = &RegisterResData{}
+	if str == "" {
+		return
+	}
+	err = json.Unmarshal([]byte(str), data)
+	return
+}
+
+func MarshalRegisterResData(mux bool, salt string) (data string, err error) {
+	var bytes []byte
+	bytes, err = json.Marshal(&RegisterResData{Mux: mux, Salt: salt})
+	if err != nil {
+		return
+	}
+	data = string(bytes)
 	return
 }
 
 type CreateConnData struct {
 	ServerID  string `json:"forward_server_id"`
 	ForwardID string `json:"forward_id"`
+	// Compression and Encryption are proposed by nhole-server and echoed by
+	// nhole-client, the forward connection is wrapped after this message.
+	Compression bool `json:"use_compression,omitempty"`
+	Encryption  bool `json:"use_encryption,omitempty"`
+	// Salt keys the encryption of a multiplexed stream, which has no
+	// forward REGISTER.
+	Salt string `json:"salt,omitempty"`
 }
 
 func NewCreateConnData(serverID, forwardID string) (c *CreateConnData) {
@@ -89,9 +183,9 @@ func UnmarshalCreateConnData(str string) (data *CreateConnData, err error) {
 	return
 }
 
-func MarshalCreateConnData(serverID, forwardID string) (data string, err error) {
+func MarshalCreateConnData(c *CreateConnData) (data string, err error) {
 	var bytes []byte
-	bytes, err = json.Marshal(NewCreateConnData(serverID, forwardID))
+	bytes, err = json.Marshal(c)
 	if err != nil {
 		return
 	}
@@ -99,12 +193,168 @@ func MarshalCreateConnData(serverID, forwardID string) (data string, err error)
 	return
 }
 
+type CreateServerData struct {
+	ServerID      string   `json:"forward_server_id"`
+	Name          string   `json:"name"`
+	ForwardPort   int      `json:"forward_port"`
+	Protocol      string   `json:"protocol"`
+	CustomDomains []string `json:"custom_domains,omitempty"`
+	// BandwidthLimit is bytes per second of each direction, 0 is unlimited.
+	BandwidthLimit int64 `json:"bandwidth_limit,omitempty"`
+	// UseCompression and UseEncryption are kept in the response when
+	// nhole-server supports them.
+	UseCompression bool `json:"use_compression,omitempty"`
+	UseEncryption  bool `json:"use_encryption,omitempty"`
+	// SecretKey is proved by the visitors of a stcp service.
+	SecretKey string `json:"secret_key,omitempty"`
+	// MaxConnections bounds concurrent visitors, 0 is unlimited.
+	MaxConnections int `json:"max_connections,omitempty"`
+	// AllowIps and DenyIps filter visitors by ip or CIDR.
+	AllowIps []string `json:"allow_ips,omitempty"`
+	DenyIps  []string `json:"deny_ips,omitempty"`
+	// Group shares one forward server among the clients with the same
+	// GroupKey, LoadBalance spreads the visitors over them.
+	Group       string `json:"group,omitempty"`
+	GroupKey    string `json:"group_key,omitempty"`
+	LoadBalance string `json:"load_balance,omitempty"`
+}
+
+func NewCreateServerData(forwardPort int, protocol string) (c *CreateServerData) {
+	c = &CreateServerData{
+		ForwardPort: forwardPort,
+		Protocol:    protocol,
+	}
+	return
+}
+
+// UnmarshalCreateServerData also accepts the bare forward port sent by
+// older clients, which is kept as the server ID.
+func UnmarshalCreateServerData(str string) (data *CreateServerData, err error) {
+	if port, atoiErr := strconv.Atoi(str); atoiErr == nil {
+		data = NewCreateServerData(port, TCP)
+		data.ServerID = str
+		return
+	}
+	data = &CreateServerData{}
+	err = json.Unmarshal([]byte(str), data)
+	if err != nil {
+		return
+	}
+	if data.Protocol == "" {
+		data.Protocol = TCP
+	}
+	return
+}
+
+func MarshalCreateServerData(c *CreateServerData) (data string, err error) {
+	var bytes []byte
+	bytes, err = json.Marshal(c)
+	if err != nil {
+		return
+	}
+	data = string(bytes)
+	return
+}
+
+// CloseServerData is the data of CLOSE_FORWARD_SERVER.
+type CloseServerData struct {
+	ServerID string `json:"forward_server_id"`
+	Name     string `json:"name"`
+}
+
+func UnmarshalCloseServerData(str string) (data *CloseServerData, err error) {
+	data = &CloseServerData{}
+	err = json.Unmarshal([]byte(str), data)
+	return
+}
+
+func MarshalCloseServerData(c *CloseServerData) (data string, err error) {
+	var bytes []byte
+	bytes, err = json.Marshal(c)
+	if err != nil {
+		return
+	}
+	data = string(bytes)
+	return
+}
+
+// VisitorConnData is the data of CREATE_VISITOR_CONN, Auth is register data
+// signed with the secret key of the stcp service Name.
+type VisitorConnData struct {
+	Name string `json:"name"`
+	Auth string `json:"auth"`
+	// Sid identifies the nat hole punching of NAT_HOLE.
+	Sid string `json:"sid,omitempty"`
+}
+
+func UnmarshalVisitorConnData(str string) (data *VisitorConnData, err error) {
+	data = &VisitorConnData{}
+	err = json.Unmarshal([]byte(str), data)
+	return
+}
+
+func MarshalVisitorConnData(c *VisitorConnData) (data string, err error) {
+	var bytes []byte
+	bytes, err = json.Marshal(c)
+	if err != nil {
+		return
+	}
+	data = string(bytes)
+	return
+}
+
+// NatHoleData is the data of NAT_HOLE, nhole-server sends ServerID, Sid and
+// Port of its udp nat hole server to the nhole-client of a xtcp service, and
+// answers the udp probes of both peers with the observed addresses.
+type NatHoleData struct {
+	ServerID string `json:"forward_server_id,omitempty"`
+	Sid      string `json:"sid"`
+	Port     int    `json:"port,omitempty"`
+	Addr     string `json:"addr,omitempty"`
+	PeerAddr string `json:"peer_addr,omitempty"`
+}
+
+func UnmarshalNatHoleData(str string) (data *NatHoleData, err error) {
+	data = &NatHoleData{}
+	err = json.Unmarshal([]byte(str), data)
+	return
+}
+
+func MarshalNatHoleData(c *NatHoleData) (data string, err error) {
+	var bytes []byte
+	bytes, err = json.Marshal(c)
+	if err != nil {
+		return
+	}
+	data = string(bytes)
+	return
+}
+
+func ValidateProtocol(protocol string) (err error) {
+	switch protocol {
+	case TCP:
+	case UDP:
+	case HTTP:
+	case HTTPS:
+	case STCP:
+	case XTCP:
+	default:
+		err = fmt.Errorf("%s ValidateProtocol error", protocol)
+	}
+	return
+}
+
 func ValidateOperation(operation string) (err error) {
 	switch operation {
 	case REGISTER:
 	case CreateForwardConn:
 	case CreateForwardServer:
+	case CloseForwardServer:
 	case HEARTBEAT:
+	case SHUTDOWN:
+	case CreateVisitorConn:
+	case NatHole:
+	case PoolForwardConn:
 	default:
 		err = fmt.Errorf("%s ValidateOperation error", operation)
 	}
@@ -115,6 +365,7 @@ func ValidateConnType(connType string) (err error) {
 	switch connType {
 	case ControlConn:
 	case ForwardConn:
+	case VisitorConn:
 	default:
 		err = fmt.Errorf("%s ValidateConnType error", connType)
 	}
@@ -0,0 +1,235 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	counterType   = "counter"
+	gaugeType     = "gauge"
+	histogramType = "histogram"
+)
+
+// DefBuckets are latency buckets in seconds.
+var DefBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Value is one sample of a counter or a gauge.
+type Value struct {
+	bits uint64
+}
+
+func (v *Value) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		n := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, n) {
+			return
+		}
+	}
+}
+
+func (v *Value) Inc() {
+	v.Add(1)
+}
+
+func (v *Value) Dec() {
+	v.Add(-1)
+}
+
+func (v *Value) Set(value float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(value))
+}
+
+func (v *Value) Get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     Value
+}
+
+func (h *Histogram) Observe(value float64) {
+	for i, bound := range h.buckets {
+		if value <= bound {
+			atomic.AddUint64(&h.counts[i], 1)
+		}
+	}
+	atomic.AddUint64(&h.count, 1)
+	h.sum.Add(value)
+}
+
+// Vec is a metric family, every label value combination is one child.
+type Vec struct {
+	name       string
+	help       string
+	metricType string
+	labels     []string
+	buckets    []float64
+	fn         func() float64
+
+	children map[string]interface{}
+	values   map[string][]string
+	sync.RWMutex
+}
+
+func (v *Vec) child(labelValues []string) interface{} {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s wants %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	v.RLock()
+	c, ok := v.children[key]
+	v.RUnlock()
+	if ok {
+		return c
+	}
+	v.Lock()
+	defer v.Unlock()
+	if c, ok = v.children[key]; ok {
+		return c
+	}
+	if v.metricType == histogramType {
+		c = &Histogram{
+			buckets: v.buckets,
+			counts:  make([]uint64, len(v.buckets)),
+		}
+	} else {
+		c = &Value{}
+	}
+	v.children[key] = c
+	v.values[key] = append([]string(nil), labelValues...)
+	return c
+}
+
+// With returns the counter or gauge of labelValues.
+func (v *Vec) With(labelValues ...string) *Value {
+	return v.child(labelValues).(*Value)
+}
+
+// Histogram returns the histogram of labelValues.
+func (v *Vec) Histogram(labelValues ...string) *Histogram {
+	return v.child(labelValues).(*Histogram)
+}
+
+// Registry holds metric families and writes them in the Prometheus text format.
+type Registry struct {
+	vecs []*Vec
+	sync.Mutex
+}
+
+func NewRegistry() (r *Registry) {
+	r = &Registry{
+		vecs: make([]*Vec, 0),
+	}
+	return
+}
+
+func (r *Registry) register(v *Vec) *Vec {
+	v.children = make(map[string]interface{}, 0)
+	v.values = make(map[string][]string, 0)
+	r.Lock()
+	defer r.Unlock()
+	r.vecs = append(r.vecs, v)
+	return v
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Vec {
+	return r.register(&Vec{name: name, help: help, metricType: counterType, labels: labels})
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Vec {
+	return r.register(&Vec{name: name, help: help, metricType: gaugeType, labels: labels})
+}
+
+// NewGaugeFunc reports fn at every scrape.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) *Vec {
+	return r.register(&Vec{name: name, help: help, metricType: gaugeType, fn: fn})
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Vec {
+	return r.register(&Vec{name: name, help: help, metricType: histogramType, labels: labels, buckets: buckets})
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (v *Vec) write(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", v.name, v.metricType)
+	if v.fn != nil {
+		fmt.Fprintf(buf, "%s %s\n", v.name, formatFloat(v.fn()))
+		return
+	}
+	v.RLock()
+	defer v.RUnlock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		values := v.values[key]
+		switch c := v.children[key].(type) {
+		case *Value:
+			fmt.Fprintf(buf, "%s%s %s\n", v.name, formatLabels(v.labels, values), formatFloat(c.Get()))
+		case *Histogram:
+			for i, bound := range c.buckets {
+				fmt.Fprintf(buf, "%s_bucket%s %d\n",
+					v.name, formatLabels(v.labels, values, "le", formatFloat(bound)), atomic.LoadUint64(&c.counts[i]))
+			}
+			count := atomic.LoadUint64(&c.count)
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, values, "le", "+Inf"), count)
+			fmt.Fprintf(buf, "%s_sum%s %s\n", v.name, formatLabels(v.labels, values), formatFloat(c.sum.Get()))
+			fmt.Fprintf(buf, "%s_count%s %d\n", v.name, formatLabels(v.labels, values), count)
+		}
+	}
+}
+
+func (r *Registry) Bytes() []byte {
+	r.Lock()
+	vecs := append([]*Vec(nil), r.vecs...)
+	r.Unlock()
+	buf := new(bytes.Buffer)
+	for _, v := range vecs {
+		v.write(buf)
+	}
+	return buf.Bytes()
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(r.Bytes())
+}
@@ -0,0 +1,31 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	bytesTotal := r.NewCounter("nhole_bytes_total", "Forwarded bytes.", "service", "direction")
+	bytesTotal.With("ssh", "in").Add(100)
+	bytesTotal.With("ssh", "in").Add(20)
+	r.NewGaugeFunc("nhole_clients", "Connected clients.", func() float64 { return 3 })
+	rtt := r.NewHistogram("nhole_rtt_seconds", "Round-trip time.", []float64{0.1, 1})
+	rtt.Histogram().Observe(0.5)
+	out := string(r.Bytes())
+	for _, want := range []string{
+		"# TYPE nhole_bytes_total counter\n",
+		`nhole_bytes_total{service="ssh",direction="in"} 120` + "\n",
+		"nhole_clients 3\n",
+		`nhole_rtt_seconds_bucket{le="0.1"} 0` + "\n",
+		`nhole_rtt_seconds_bucket{le="1"} 1` + "\n",
+		`nhole_rtt_seconds_bucket{le="+Inf"} 1` + "\n",
+		"nhole_rtt_seconds_sum 0.5\n",
+		"nhole_rtt_seconds_count 1\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q in\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package tools
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Backoff computes exponentially growing retry intervals with random jitter
+// so that many clients do not retry at the same moment.
+type Backoff struct {
+	initial    time.Duration
+	max        time.Duration
+	multiplier float64
+	jitter     float64
+
+	attempts int
+	sync.Mutex
+}
+
+func NewBackoff(initial, max time.Duration, multiplier, jitter float64) (b *Backoff) {
+	b = &Backoff{
+		initial:    initial,
+		max:        max,
+		multiplier: multiplier,
+		jitter:     jitter,
+	}
+	return
+}
+
+// Next returns the interval to wait before the next attempt.
+func (b *Backoff) Next() (d time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	interval := float64(b.initial) * math.Pow(b.multiplier, float64(b.attempts))
+	if interval > float64(b.max) {
+		interval = float64(b.max)
+	}
+	b.attempts++
+	interval += interval * b.jitter * (2*rand.Float64() - 1)
+	if interval > float64(b.max) {
+		interval = float64(b.max)
+	}
+	d = time.Duration(interval)
+	return
+}
+
+func (b *Backoff) Attempts() (n int) {
+	b.Lock()
+	defer b.Unlock()
+	n = b.attempts
+	return
+}
+
+func (b *Backoff) Reset() {
+	b.Lock()
+	defer b.Unlock()
+	b.attempts = 0
+}
@@ -0,0 +1,93 @@
+package tools
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// IPFilter decides by source ip, deny wins over allow and an empty allow
+// list allows every ip that is not denied.
+type IPFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func parseIPNets(list []string) (nets []*net.IPNet, err error) {
+	nets = make([]*net.IPNet, 0, len(list))
+	for _, str := range list {
+		str = strings.TrimSpace(str)
+		if !strings.Contains(str, "/") {
+			ip := net.ParseIP(str)
+			if ip == nil {
+				err = fmt.Errorf("bad ip %s", str)
+				return
+			}
+			if ip.To4() != nil {
+				str += "/32"
+			} else {
+				str += "/128"
+			}
+		}
+		var ipNet *net.IPNet
+		_, ipNet, err = net.ParseCIDR(str)
+		if err != nil {
+			err = fmt.Errorf("bad cidr %s", str)
+			return
+		}
+		nets = append(nets, ipNet)
+	}
+	return
+}
+
+// ParseIPFilter parses ips and CIDRs such as "10.0.0.0/8" or "192.168.1.2".
+func ParseIPFilter(allow, deny []string) (f *IPFilter, err error) {
+	f = &IPFilter{}
+	f.allow, err = parseIPNets(allow)
+	if err != nil {
+		return
+	}
+	f.deny, err = parseIPNets(deny)
+	return
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed reports whether ip may connect, a nil filter allows everyone.
+func (f *IPFilter) Allowed(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+	if containsIP(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
+
+// AllowedAddr is Allowed for the ip of addr, such as conn.RemoteAddr().
+func (f *IPFilter) AllowedAddr(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return false
+	}
+	return f.Allowed(ip)
+}
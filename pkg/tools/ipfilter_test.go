@@ -0,0 +1,33 @@
+package tools
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPFilter(t *testing.T) {
+	f, err := ParseIPFilter([]string{"10.0.0.0/8", "192.168.1.2", "::1"}, []string{"10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"10.0.0.1":    true,
+		"10.1.2.3":    false,
+		"192.168.1.2": true,
+		"192.168.1.3": false,
+		"::1":         true,
+	} {
+		if f.Allowed(net.ParseIP(ip)) != want {
+			t.Fatalf("Allowed(%s) != %v", ip, want)
+		}
+	}
+	f, _ = ParseIPFilter(nil, []string{"1.2.3.4"})
+	if f.Allowed(net.ParseIP("1.2.3.4")) || !f.Allowed(net.ParseIP("1.2.3.5")) {
+		t.Fatal("deny only filter")
+	}
+	for _, s := range []string{"10.0.0.0/33", "host", "1.2.3"} {
+		if _, err = ParseIPFilter([]string{s}, nil); err == nil {
+			t.Fatalf("%s accepted", s)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package tools
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type PortRange struct {
+	Start int
+	End   int
+}
+
+// PortRanges is a set of ports such as "2000-3000,4000", an empty set allows every port.
+type PortRanges []PortRange
+
+func ParsePortRanges(s string) (ranges PortRanges, err error) {
+	ranges = make(PortRanges, 0)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var (
+			start, end int
+			bounds     = strings.SplitN(part, "-", 2)
+		)
+		start, err = strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			err = fmt.Errorf("%s ParsePortRanges error", part)
+			return
+		}
+		end = start
+		if len(bounds) == 2 {
+			end, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+			if err != nil {
+				err = fmt.Errorf("%s ParsePortRanges error", part)
+				return
+			}
+		}
+		if start <= 0 || end > 65535 || start > end {
+			err = fmt.Errorf("%s ParsePortRanges error", part)
+			return
+		}
+		ranges = append(ranges, PortRange{Start: start, End: end})
+	}
+	return
+}
+
+func (r PortRanges) Contains(port int) bool {
+	if len(r) == 0 {
+		return true
+	}
+	for _, value := range r {
+		if port >= value.Start && port <= value.End {
+			return true
+		}
+	}
+	return false
+}
+
+func (r PortRanges) Ports() (ports []int) {
+	ports = make([]int, 0)
+	for _, value := range r {
+		for port := value.Start; port <= value.End; port++ {
+			ports = append(ports, port)
+		}
+	}
+	return
+}
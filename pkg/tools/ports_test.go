@@ -0,0 +1,24 @@
+package tools
+
+import "testing"
+
+func TestParsePortRanges(t *testing.T) {
+	ranges, err := ParsePortRanges("2000-3000, 4000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for port, want := range map[int]bool{1999: false, 2000: true, 3000: true, 3500: false, 4000: true} {
+		if ranges.Contains(port) != want {
+			t.Fatalf("Contains(%d) != %v", port, want)
+		}
+	}
+	ranges, _ = ParsePortRanges("")
+	if !ranges.Contains(22) {
+		t.Fatal("empty ranges should allow every port")
+	}
+	for _, s := range []string{"3000-2000", "a-b", "0", "70000"} {
+		if _, err = ParsePortRanges(s); err == nil {
+			t.Fatalf("%s accepted", s)
+		}
+	}
+}
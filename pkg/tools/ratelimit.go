@@ -0,0 +1,115 @@
+package tools
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var bandwidthUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// ParseBandwidth parses bytes per second such as "512KB" or "10MB",
+// units are powers of 1024 and an empty string means unlimited (0).
+func ParseBandwidth(str string) (limit int64, err error) {
+	str = strings.ToUpper(strings.TrimSpace(str))
+	if str == "" {
+		return
+	}
+	size := int64(1)
+	for _, unit := range bandwidthUnits {
+		if strings.HasSuffix(str, unit.suffix) {
+			str, size = strings.TrimSpace(strings.TrimSuffix(str, unit.suffix)), unit.size
+			break
+		}
+	}
+	var n float64
+	n, err = strconv.ParseFloat(str, 64)
+	if err != nil || n <= 0 {
+		err = fmt.Errorf("bad bandwidth %s", str)
+		return
+	}
+	limit = int64(n * float64(size))
+	if limit < 1 {
+		limit = 1
+	}
+	return
+}
+
+// RateLimiter is a token bucket of bytes per second that holds at most one
+// second of tokens, a rate <= 0 is unlimited.
+type RateLimiter struct {
+	rate   int64
+	tokens float64
+	last   time.Time
+	sync.Mutex
+}
+
+func NewRateLimiter(rate int64) (r *RateLimiter) {
+	r = &RateLimiter{
+		rate:   rate,
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+	return
+}
+
+// SetRate changes the rate, waiting readers and writers keep their debt.
+func (r *RateLimiter) SetRate(rate int64) {
+	r.Lock()
+	defer r.Unlock()
+	r.rate = rate
+	if r.tokens > float64(rate) {
+		r.tokens = float64(rate)
+	}
+}
+
+func (r *RateLimiter) Rate() (rate int64) {
+	r.Lock()
+	defer r.Unlock()
+	rate = r.rate
+	return
+}
+
+// Burst is the largest chunk worth taking at once, 0 is unlimited.
+func (r *RateLimiter) Burst() (n int) {
+	r.Lock()
+	defer r.Unlock()
+	if r.rate > 0 {
+		n = int(r.rate)
+	}
+	return
+}
+
+// WaitN takes n tokens and sleeps until the bucket is no longer in debt.
+func (r *RateLimiter) WaitN(n int) {
+	r.Lock()
+	if r.rate <= 0 {
+		r.Unlock()
+		return
+	}
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * float64(r.rate)
+	if r.tokens > float64(r.rate) {
+		r.tokens = float64(r.rate)
+	}
+	r.last = now
+	r.tokens -= float64(n)
+	var wait time.Duration
+	if r.tokens < 0 {
+		wait = time.Duration(-r.tokens / float64(r.rate) * float64(time.Second))
+	}
+	r.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
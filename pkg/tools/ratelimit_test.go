@@ -0,0 +1,41 @@
+package tools
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	for str, want := range map[string]int64{"": 0, "100": 100, "512KB": 512 << 10, "10MB": 10 << 20, "1.5mb": 3 << 19, "1GB": 1 << 30} {
+		limit, err := ParseBandwidth(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if limit != want {
+			t.Fatalf("ParseBandwidth(%q) = %d, want %d", str, limit, want)
+		}
+	}
+	for _, str := range []string{"MB", "-1KB", "10TB", "fast"} {
+		if _, err := ParseBandwidth(str); err == nil {
+			t.Fatalf("%s accepted", str)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	r := NewRateLimiter(100 << 10)
+	start := time.Now()
+	// one second of burst, then 50KB more at 100KB/s
+	for i := 0; i < 15; i++ {
+		r.WaitN(10 << 10)
+	}
+	if d := time.Since(start); d < 400*time.Millisecond || d > 5*time.Second {
+		t.Fatalf("150KB at 100KB/s took %s", d)
+	}
+	r.SetRate(0)
+	start = time.Now()
+	r.WaitN(1 << 30)
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("unlimited took %s", d)
+	}
+}
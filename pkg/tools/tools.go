@@ -107,22 +107,82 @@ func Bytes2Uint32(bs []byte) (n int) {
 	return
 }
 
+const (
+	// ExitDrainTimeout is the exit status when forwarded connections were
+	// force closed on shutdown.
+	ExitDrainTimeout = 2
+)
+
 type Releaser interface {
 	Release()
 }
 
-func ExitClear(r Releaser, exitInfo string) {
+// Shutdowner drains its connections before releasing them.
+type Shutdowner interface {
+	Releaser
+	Shutdown() (err error)
+}
+
+// Reloader re-reads its config file on SIGHUP.
+type Reloader interface {
+	Reload() (err error)
+}
+
+// ExitClear waits for an exit signal and releases r, a Shutdowner is drained
+// first unless a second signal arrives. SIGHUP reloads a Reloader.
+func ExitClear(r Releaser, exitInfo string) (err error) {
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(
 		signalCh,
 		os.Interrupt,
-		//syscall.SIGHUP,
+		syscall.SIGHUP,
 		syscall.SIGINT,
 		syscall.SIGQUIT,
 		syscall.SIGKILL,
 		syscall.SIGTERM,
 	)
-	_ = <-signalCh
+	for sig := range signalCh {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		reloader, ok := r.(Reloader)
+		if !ok {
+			continue
+		}
+		if reloadErr := reloader.Reload(); reloadErr != nil {
+			log.Error("reload config %s", reloadErr.Error())
+		} else {
+			log.Info("reload config ...")
+		}
+	}
 	log.Info(exitInfo)
-	r.Release()
+	s, ok := r.(Shutdowner)
+	if !ok {
+		r.Release()
+		return
+	}
+	doneCh := make(chan error, 1)
+	go func() {
+		doneCh <- s.Shutdown()
+	}()
+	select {
+	case err = <-doneCh:
+	case <-waitExitSignal(signalCh):
+		err = fmt.Errorf("shutdown interrupted, force close")
+		r.Release()
+	}
+	return
+}
+
+func waitExitSignal(signalCh chan os.Signal) (exitCh chan struct{}) {
+	exitCh = make(chan struct{})
+	go func() {
+		for sig := range signalCh {
+			if sig != syscall.SIGHUP {
+				close(exitCh)
+				return
+			}
+		}
+	}()
+	return
 }
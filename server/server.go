@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"os"
 
 	"github.com/biandc/nhole/pkg/config"
 	"github.com/biandc/nhole/pkg/control"
@@ -16,7 +17,7 @@ var (
 	LogDisableColor bool
 )
 
-func Run(cfg *config.ServerCfg) (err error) {
+func Run(cfgFile string, cfg *config.ServerCfg) (err error) {
 	tools.PrintLogo()
 	log.InitLog(LogWay, LogFile, LogLevel, LogDisableColor)
 
@@ -24,12 +25,17 @@ func Run(cfg *config.ServerCfg) (err error) {
 		server *control.ControlServ
 	)
 	ctx := context.WithValue(context.Background(), "cfg", cfg)
+	ctx = context.WithValue(ctx, "cfgFile", cfgFile)
 	server, err = control.NewControlServer(ctx, cfg.Server.Ip, cfg.Server.ControlPort)
 	if err != nil {
 		return
 	}
 	log.Info("nhole-server start ...")
 	server.Run()
-	tools.ExitClear(server, "nhole-server exit ...")
+	err = tools.ExitClear(server, "nhole-server exit ...")
+	if err != nil {
+		log.Error(err.Error())
+		os.Exit(tools.ExitDrainTimeout)
+	}
 	return
 }